@@ -2,22 +2,49 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/navikt/knep/pkg/api"
+	"github.com/navikt/knep/pkg/guardrails"
+	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/k8s"
+	"github.com/navikt/knep/pkg/metrics"
 	"github.com/navikt/knep/pkg/statswriter"
+	"github.com/navikt/knep/pkg/workload"
 )
 
 type Config struct {
-	CertPath                string
-	InCluster               bool
-	WriteStatistics         bool
-	OnpremHostMapFilePath   string
-	ExternalHostMapFilePath string
-	BigQuery                statswriter.BigQuery
+	CertPath                 string
+	MetricsAddress           string
+	InCluster                bool
+	WriteStatistics          bool
+	OwnerReferences          bool
+	DryRun                   bool
+	SharedDAGRunPolicies     bool
+	InvalidEntryPolicy       string
+	PolicyBackend            string
+	PortConflictPolicy       string
+	MaxPortRangeSize         int
+	StatisticsQueueSize      int
+	StatisticsOverflowPolicy string
+	StatisticsSpillDir       string
+	OnpremHostMapFilePath    string
+	WorkloadProfilesFile     string
+	GuardrailsFile           string
+	ExternalHostMapFilePath  string
+	HostMapReloadInterval    time.Duration
+	ReconcileInterval        time.Duration
+	ShutdownDelay            time.Duration
+	ShutdownTimeout          time.Duration
+	BigQuery                 statswriter.BigQuery
 }
 
 var cfg = Config{}
@@ -26,37 +53,230 @@ func init() {
 	flag.StringVar(&cfg.BigQuery.ProjectID, "stats-bigquery-project", os.Getenv("BIGQUERY_PROJECT"), "The GCP project where allowlist statistics should be written")
 	flag.StringVar(&cfg.BigQuery.DatasetID, "stats-bigquery-dataset", os.Getenv("BIGQUERY_DATASET"), "The BigQuery dataset where allowlist statistics should be written")
 	flag.StringVar(&cfg.BigQuery.TableID, "stats-bigquery-table", os.Getenv("BIGQUERY_TABLE"), "The BigQuery dataset where allowlist statistics should be written")
+	flag.IntVar(&cfg.StatisticsQueueSize, "stats-queue-size", envIntOrDefault("STATS_QUEUE_SIZE", 100), "How many allowlist statistics can wait to be written before the overflow policy applies")
+	flag.StringVar(&cfg.StatisticsOverflowPolicy, "stats-overflow-policy", envOrDefault("STATS_OVERFLOW_POLICY", string(statswriter.OverflowPolicyDropOldest)), "What to do with allowlist statistics when the queue is full, one of drop-oldest, drop-newest or spill-to-disk")
+	flag.StringVar(&cfg.StatisticsSpillDir, "stats-spill-dir", os.Getenv("STATS_SPILL_DIR"), "The directory allowlist statistics are spilled to with the spill-to-disk overflow policy")
 	flag.StringVar(&cfg.OnpremHostMapFilePath, "onprem-hostmap-file", os.Getenv("ONPREM_HOSTMAP_FILE"), "Path to the onprem hostmap map file")
 	flag.StringVar(&cfg.ExternalHostMapFilePath, "external-hostmap-file", os.Getenv("EXTERNAL_HOSTMAP_FILE"), "Path to the external hostmap map file")
+	flag.StringVar(&cfg.WorkloadProfilesFile, "workload-profiles-file", os.Getenv("WORKLOAD_PROFILES_FILE"), "Path to a file with workload profiles, in addition to the built-in Jupyter and Airflow profiles")
+	flag.StringVar(&cfg.GuardrailsFile, "guardrails-file", os.Getenv("GUARDRAILS_FILE"), "Path to a file with guardrails restricting what users may put in their allowlists")
+	flag.DurationVar(&cfg.HostMapReloadInterval, "hostmap-reload-interval", 30*time.Second, "How often to check the hostmap files for changes, 0 disables reloading")
 	flag.StringVar(&cfg.CertPath, "cert-path", os.Getenv("CERT_PATH"), "The path to the directory containing tls certificate and key")
+	flag.StringVar(&cfg.MetricsAddress, "metrics-address", ":8080", "The address the plain HTTP metrics endpoint listens on")
 	flag.BoolVar(&cfg.InCluster, "in-cluster", true, "Whether the app is running locally or in cluster")
 	flag.BoolVar(&cfg.WriteStatistics, "write-statistics", true, "Whether to write allowlist statistics to BigQuery")
+	flag.BoolVar(&cfg.OwnerReferences, "owner-references", os.Getenv("OWNER_REFERENCES") == "true", "Whether to add owner references from pods to their network policies")
+	flag.BoolVar(&cfg.DryRun, "dry-run", os.Getenv("DRY_RUN") == "true", "Whether to only compute and report network policies instead of applying them")
+	flag.BoolVar(&cfg.SharedDAGRunPolicies, "shared-dag-run-policies", os.Getenv("SHARED_DAG_RUN_POLICIES") == "true", "Whether Airflow task pods in a DAG run with the same allowlist should share their network policies")
+	flag.StringVar(&cfg.InvalidEntryPolicy, "invalid-entry-policy", envOrDefault("INVALID_ENTRY_POLICY", string(k8s.InvalidEntryPolicyWarn)), "Whether to deny pods with invalid allowlist entries or only warn about them, one of deny or warn")
+	flag.StringVar(&cfg.PolicyBackend, "policy-backend", envOrDefault("POLICY_BACKEND", k8s.DefaultPolicyBackend), "Which policies allow egress to FQDNs, one of gke-v1alpha3, gke-v1alpha1, cilium or calico (requires Calico Enterprise or Calico Cloud for destination domains)")
+	flag.StringVar(&cfg.PortConflictPolicy, "port-conflict-policy", envOrDefault("PORT_CONFLICT_POLICY", string(hostmap.PortConflictPolicyOverride)), "How to handle allowlist ports that are not open to the host in the host map, one of override, reject or union")
+	flag.IntVar(&cfg.MaxPortRangeSize, "max-port-range-size", hostmap.DefaultMaxPortRangeSize, "The largest number of ports allowed in a port range of an allowlist entry")
+	flag.DurationVar(&cfg.ReconcileInterval, "reconcile-interval", 10*time.Minute, "How often to garbage collect orphaned network policies, 0 disables the reconciler")
+	flag.DurationVar(&cfg.ShutdownDelay, "shutdown-delay", 5*time.Second, "How long to keep serving admission requests after SIGTERM, while the pod is removed from the service endpoints")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 25*time.Second, "How long to wait for in-flight admissions and buffered allowlist statistics when shutting down")
+}
+
+func envOrDefault(key, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return defaultValue
+}
+
+// envIntOrDefault returns the number in the environment variable, exiting if it is not a
+// number as the flags are set up before there is a logger to report it with.
+func envIntOrDefault(key string, defaultValue int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Error("invalid value for environment variable", "key", key, "value", value)
+		os.Exit(1)
+	}
+
+	return number
 }
 
 func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 	flag.Parse()
 
-	statisticsChan := make(chan statswriter.AllowListStatistics, 100) // Channel can store 100 messages before becoming full
+	invalidEntryPolicy := k8s.InvalidEntryPolicy(cfg.InvalidEntryPolicy)
+	if invalidEntryPolicy != k8s.InvalidEntryPolicyDeny && invalidEntryPolicy != k8s.InvalidEntryPolicyWarn {
+		logger.Error("invalid value for invalid-entry-policy", "value", cfg.InvalidEntryPolicy)
+		os.Exit(1)
+	}
+
+	portConflictPolicy := hostmap.PortConflictPolicy(cfg.PortConflictPolicy)
+	switch portConflictPolicy {
+	case hostmap.PortConflictPolicyOverride, hostmap.PortConflictPolicyReject, hostmap.PortConflictPolicyUnion:
+	default:
+		logger.Error("invalid value for port-conflict-policy", "value", cfg.PortConflictPolicy)
+		os.Exit(1)
+	}
+
+	policyBackend, err := k8s.NewPolicyBackend(cfg.PolicyBackend)
+	if err != nil {
+		logger.Error("invalid value for policy-backend", "error", err)
+		os.Exit(1)
+	}
+
+	workloads, err := workload.Load(cfg.WorkloadProfilesFile)
+	if err != nil {
+		logger.Error("loading workload profiles", "error", err)
+		os.Exit(1)
+	}
+
+	allowlistGuardrails, err := guardrails.Load(cfg.GuardrailsFile)
+	if err != nil {
+		logger.Error("loading guardrails", "error", err)
+		os.Exit(1)
+	}
+
+	// Without a statistics writer nothing would read the queue, so no statistics are sent
+	var statistics *statswriter.Queue
+	if cfg.WriteStatistics {
+		statistics, err = statswriter.NewQueue(cfg.StatisticsQueueSize, statswriter.OverflowPolicy(cfg.StatisticsOverflowPolicy), cfg.StatisticsSpillDir, logger)
+		if err != nil {
+			logger.Error("creating statistics queue", "error", err)
+			os.Exit(1)
+		}
+	}
+	metrics.RegisterStatisticsQueueDepth(statistics.Len)
 
+	// The statistics writer outlives ctx, so the statistics queued when shutting down
+	// can still be written
+	statsCtx, cancelStats := context.WithCancel(context.Background())
+	defer cancelStats()
+	statsDone := make(chan struct{})
 	if cfg.WriteStatistics {
-		go statswriter.Run(ctx, cfg.BigQuery, statisticsChan, logger)
+		go func() {
+			statswriter.Run(statsCtx, cfg.BigQuery, statistics, logger)
+			close(statsDone)
+		}()
+	} else {
+		close(statsDone)
 	}
 
-	api, err := api.New(ctx, cfg.InCluster, cfg.OnpremHostMapFilePath, cfg.ExternalHostMapFilePath, statisticsChan, logger)
+	hostMap, err := hostmap.New(cfg.OnpremHostMapFilePath, cfg.ExternalHostMapFilePath, hostmap.Config{
+		PortConflictPolicy: portConflictPolicy,
+		MaxPortRangeSize:   cfg.MaxPortRangeSize,
+		Wildcards:          policyBackend.SupportsWildcards(),
+		FQDNPortRanges:     policyBackend.SupportsPortRanges(),
+	})
 	if err != nil {
-		logger.Error("creating api", "error", err)
+		logger.Error("creating host map", "error", err)
 		os.Exit(1)
 	}
 
-	server := http.Server{
+	if cfg.HostMapReloadInterval > 0 {
+		go hostMap.Watch(ctx, cfg.HostMapReloadInterval, logger)
+	}
+
+	k8sConfig := k8s.Config{
+		DryRun:               cfg.DryRun,
+		InvalidEntryPolicy:   invalidEntryPolicy,
+		Workloads:            workloads,
+		Guardrails:           allowlistGuardrails,
+		SharedDAGRunPolicies: cfg.SharedDAGRunPolicies,
+		PolicyBackend:        policyBackend,
+		OwnerReferences:      cfg.OwnerReferences,
+	}
+	k8sClient, err := k8s.New(cfg.InCluster, k8sConfig, hostMap, statistics, logger)
+	if err != nil {
+		logger.Error("creating k8s client", "error", err)
+		os.Exit(1)
+	}
+
+	if err := k8sClient.StartNamespaceInformer(ctx); err != nil {
+		logger.Error("starting namespace informer", "error", err)
+		os.Exit(1)
+	}
+
+	if cfg.OwnerReferences {
+		go k8sClient.RunOwnerReferencer(ctx)
+	}
+
+	if cfg.ReconcileInterval > 0 {
+		go k8sClient.RunReconciler(ctx, cfg.ReconcileInterval)
+	}
+
+	api := api.New(k8sClient, logger)
+
+	metricsRouter := http.NewServeMux()
+	metricsRouter.Handle("/metrics", metrics.Handler())
+	metricsServer := &http.Server{
+		Addr:    cfg.MetricsAddress,
+		Handler: metricsRouter,
+	}
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server stopped", "error", err)
+		}
+	}()
+
+	server := &http.Server{
 		Addr:    ":9443",
 		Handler: api,
 	}
 
-	if err := server.ListenAndServeTLS(cfg.CertPath+"/tls.crt", cfg.CertPath+"/tls.key"); err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServeTLS(cfg.CertPath+"/tls.crt", cfg.CertPath+"/tls.key")
+	}()
+
+	select {
+	case err := <-serverErr:
 		logger.Error("server stopped", "error", err)
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// The pod is removed from the endpoints of the service after it is sent SIGTERM, so
+	// admission requests are still served until the API server stops sending them
+	logger.Info("shutting down", "delay", cfg.ShutdownDelay.String(), "timeout", cfg.ShutdownTimeout.String())
+	time.Sleep(cfg.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := shutdown(shutdownCtx, server, statistics, statsDone, cancelStats, logger); err != nil {
+		logger.Error("shutting down", "error", err)
+		os.Exit(1)
+	}
+
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutting down metrics server", "error", err)
+	}
+	logger.Info("shut down")
+}
+
+// shutdown stops accepting admission requests and waits for the in-flight ones, before
+// closing the statistics queue and waiting for the statistics writer to write the
+// queued statistics. Statistics left when ctx is done are handled by the writer.
+func shutdown(ctx context.Context, server *http.Server, statistics *statswriter.Queue, statsDone <-chan struct{}, cancelStats context.CancelFunc, logger *slog.Logger) error {
+	// Admissions still running when the server fails to shut down drop their statistics
+	serverErr := server.Shutdown(ctx)
+
+	logger.Info("writing queued allowlist statistics", "queued", statistics.Len())
+	statistics.Close()
+
+	select {
+	case <-statsDone:
+	case <-ctx.Done():
+		cancelStats()
+		<-statsDone
+	}
+
+	if serverErr != nil {
+		return serverErr
 	}
+	return ctx.Err()
 }
@@ -8,9 +8,9 @@ import (
 	"log/slog"
 	"net/http"
 
-	"github.com/navikt/knep/pkg/hostmap"
 	"github.com/navikt/knep/pkg/k8s"
-	"github.com/navikt/knep/pkg/statswriter"
+	"github.com/navikt/knep/pkg/metrics"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -20,55 +20,179 @@ type AdmissionHandler struct {
 	logger    *slog.Logger
 }
 
-func NewAdmissionHandler(ctx context.Context, inCluster bool, hostMap *hostmap.HostMap, statisticsChan chan statswriter.AllowListStatistics, logger *slog.Logger) (*AdmissionHandler, error) {
-	k8sClient, err := k8s.New(inCluster, hostMap, statisticsChan, logger)
-	if err != nil {
-		logger.Error("creating k8s client", "error", err)
-		return nil, err
-	}
+// admissionResult is the version independent outcome of an admission review.
+// A nil status means the request is allowed.
+type admissionResult struct {
+	status   *v1.Status
+	warnings []string
+	patch    []byte
+}
 
+type reviewFunc func(ctx context.Context, request k8s.AdmissionRequest) admissionResult
+
+func NewAdmissionHandler(k8sClient *k8s.K8SClient, logger *slog.Logger) *AdmissionHandler {
 	return &AdmissionHandler{
 		k8sClient: k8sClient,
 		logger:    logger,
-	}, nil
+	}
 }
 
 func (a *AdmissionHandler) Validate(w http.ResponseWriter, r *http.Request) {
+	a.serveAdmission(w, r, "validate", a.validate)
+}
+
+func (a *AdmissionHandler) Mutate(w http.ResponseWriter, r *http.Request) {
+	a.serveAdmission(w, r, "mutate", a.mutate)
+}
+
+func (a *AdmissionHandler) serveAdmission(w http.ResponseWriter, r *http.Request, webhook string, review reviewFunc) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		a.logger.Error("reading request body", "error", err)
+		http.Error(w, "reading request body", http.StatusBadRequest)
+		return
+	}
+
+	var typeMeta v1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		a.logger.Error("unmarshalling admission request", "error", err)
+		http.Error(w, "unmarshalling admission request", http.StatusBadRequest)
 		return
 	}
 
-	var review v1beta1.AdmissionReview
-	if err := json.Unmarshal(body, &review); err != nil {
+	var response any
+	switch typeMeta.APIVersion {
+	case admissionv1.SchemeGroupVersion.String():
+		response, err = a.reviewV1(r.Context(), body, webhook, review)
+	case v1beta1.SchemeGroupVersion.String():
+		response, err = a.reviewV1beta1(r.Context(), body, webhook, review)
+	default:
+		err = fmt.Errorf("unsupported admission review version %q", typeMeta.APIVersion)
+	}
+	if err != nil {
 		a.logger.Error("unmarshalling admission request", "error", err)
+		metrics.AdmissionRequests.WithLabelValues(webhook, "unknown", "error").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	a.logger.Info(fmt.Sprintf("admission request for %s/%s", review.Request.Namespace, review.Request.Name))
-	if err := a.k8sClient.AlterNetpol(r.Context(), review.Request); err != nil {
+	resp, err := json.Marshal(response)
+	if err != nil {
+		a.logger.Error("marshalling admission response", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (a *AdmissionHandler) reviewV1(ctx context.Context, body []byte, webhook string, review reviewFunc) (*admissionv1.AdmissionReview, error) {
+	var admissionReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &admissionReview); err != nil {
+		return nil, err
+	}
+	if admissionReview.Request == nil {
+		return nil, fmt.Errorf("admission review has no request")
+	}
+
+	request := admissionReview.Request
+	result := review(ctx, k8s.AdmissionRequest{
+		UID:       request.UID,
+		Name:      request.Name,
+		Namespace: request.Namespace,
+		Operation: k8s.Operation(request.Operation),
+		Object:    request.Object.Raw,
+		OldObject: request.OldObject.Raw,
+		DryRun:    request.DryRun != nil && *request.DryRun,
+	})
+	recordOutcome(webhook, string(request.Operation), result)
+
+	admissionReview.Response = &admissionv1.AdmissionResponse{
+		Allowed:  result.status == nil,
+		UID:      request.UID,
+		Result:   result.status,
+		Warnings: result.warnings,
+	}
+	if result.patch != nil {
+		patchType := admissionv1.PatchTypeJSONPatch
+		admissionReview.Response.Patch = result.patch
+		admissionReview.Response.PatchType = &patchType
+	}
+
+	return &admissionReview, nil
+}
+
+func (a *AdmissionHandler) reviewV1beta1(ctx context.Context, body []byte, webhook string, review reviewFunc) (*v1beta1.AdmissionReview, error) {
+	var admissionReview v1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &admissionReview); err != nil {
+		return nil, err
+	}
+	if admissionReview.Request == nil {
+		return nil, fmt.Errorf("admission review has no request")
+	}
+
+	request := admissionReview.Request
+	result := review(ctx, k8s.AdmissionRequest{
+		UID:       request.UID,
+		Name:      request.Name,
+		Namespace: request.Namespace,
+		Operation: k8s.Operation(request.Operation),
+		Object:    request.Object.Raw,
+		OldObject: request.OldObject.Raw,
+		DryRun:    request.DryRun != nil && *request.DryRun,
+	})
+	recordOutcome(webhook, string(request.Operation), result)
+
+	admissionReview.Response = &v1beta1.AdmissionResponse{
+		Allowed:  result.status == nil,
+		UID:      request.UID,
+		Result:   result.status,
+		Warnings: result.warnings,
+	}
+	if result.patch != nil {
+		patchType := v1beta1.PatchTypeJSONPatch
+		admissionReview.Response.Patch = result.patch
+		admissionReview.Response.PatchType = &patchType
+	}
+
+	return &admissionReview, nil
+}
+
+func recordOutcome(webhook, operation string, result admissionResult) {
+	outcome := "allowed"
+	if result.status != nil {
+		outcome = "denied"
+	}
+
+	metrics.AdmissionRequests.WithLabelValues(webhook, operation, outcome).Inc()
+}
+
+// validate alters the network policies for the admission request and returns
+// whether the request is allowed, together with any warnings for the user.
+func (a *AdmissionHandler) validate(ctx context.Context, request k8s.AdmissionRequest) admissionResult {
+	a.logger.Info(fmt.Sprintf("admission request for %s/%s", request.Namespace, request.Name))
+	warnings, err := a.k8sClient.AlterNetpol(ctx, request)
+	if err != nil {
 		a.logger.Error("altering netpol", "error", err)
-		review.Response = &v1beta1.AdmissionResponse{
-			Allowed: false,
-			UID:     review.Request.UID,
-			Result: &v1.Status{
+		return admissionResult{
+			status: &v1.Status{
 				Status:  "Failure",
 				Message: err.Error(),
 			},
-		}
-	} else {
-		review.Response = &v1beta1.AdmissionResponse{
-			Allowed: true,
-			UID:     review.Request.UID,
+			warnings: warnings,
 		}
 	}
 
-	resp, err := json.Marshal(review)
+	return admissionResult{warnings: warnings}
+}
+
+// mutate normalises the allowlist of the pod in the admission request. It never denies
+// the request, invalid allowlists are reported by the validating webhook.
+func (a *AdmissionHandler) mutate(ctx context.Context, request k8s.AdmissionRequest) admissionResult {
+	patch, err := a.k8sClient.MutatePod(ctx, request)
 	if err != nil {
-		a.logger.Error("marshalling admission response", "error", err)
+		a.logger.Error("mutating pod", "error", err, "namespace", request.Namespace, "name", request.Name)
+		return admissionResult{}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(resp)
+	return admissionResult{patch: patch}
 }
@@ -0,0 +1,717 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/guardrails"
+	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/k8s"
+	"github.com/navikt/knep/pkg/metrics"
+	"github.com/navikt/knep/pkg/statswriter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+func newTestAdmissionHandler(t *testing.T, cfg k8s.Config, objects ...runtime.Object) (*AdmissionHandler, *fake.Clientset) {
+	t.Helper()
+
+	hostMap, err := hostmap.New("testdata/onprem-hosts.yaml", "testdata/external-hosts.yaml", hostmap.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := fake.NewClientset(objects...)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.gke.io", Version: "v1alpha3", Resource: "fqdnnetworkpolicies"}: "FQDNNetworkPolicyList",
+		{Group: "knep.knada.io", Version: "v1alpha1", Resource: "allowlists"}:              "AllowlistList",
+	})
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	statistics, err := statswriter.NewQueue(10, statswriter.OverflowPolicyDropNewest, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k8sClient := k8s.NewWithClients(client, dynamicClient, metadatafake.NewSimpleMetadataClient(metadatafake.NewTestScheme()), cfg, hostMap, statistics, logger)
+	if err := k8sClient.StartNamespaceInformer(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewAdmissionHandler(k8sClient, logger), client
+}
+
+func Test_Validate(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	existingNetpol := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "jupyter-user",
+			Namespace: "team-a",
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "knep"},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		fixture       string
+		apiVersion    string
+		operation     string
+		existing      []runtime.Object
+		wantNetpolErr func(error) bool
+	}{
+		{
+			name:          "v1 create",
+			fixture:       "testdata/admissionreview-v1-create.json",
+			apiVersion:    "admission.k8s.io/v1",
+			operation:     "CREATE",
+			wantNetpolErr: func(err error) bool { return err == nil },
+		},
+		{
+			name:          "v1beta1 create",
+			fixture:       "testdata/admissionreview-v1beta1-create.json",
+			apiVersion:    "admission.k8s.io/v1beta1",
+			operation:     "CREATE",
+			wantNetpolErr: func(err error) bool { return err == nil },
+		},
+		{
+			name:          "v1 delete",
+			fixture:       "testdata/admissionreview-v1-delete.json",
+			apiVersion:    "admission.k8s.io/v1",
+			operation:     "DELETE",
+			existing:      []runtime.Object{existingNetpol},
+			wantNetpolErr: apierrors.IsNotFound,
+		},
+		{
+			name:          "v1beta1 delete",
+			fixture:       "testdata/admissionreview-v1beta1-delete.json",
+			apiVersion:    "admission.k8s.io/v1beta1",
+			operation:     "DELETE",
+			existing:      []runtime.Object{existingNetpol},
+			wantNetpolErr: apierrors.IsNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, client := newTestAdmissionHandler(t, k8s.Config{}, append(tt.existing, namespace)...)
+
+			body, err := os.ReadFile(tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			allowed := metrics.AdmissionRequests.WithLabelValues("validate", tt.operation, "allowed")
+			allowedBefore := testutil.ToFloat64(allowed)
+
+			rec := httptest.NewRecorder()
+			handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Validate() status = %v, body = %s", rec.Code, rec.Body.String())
+			}
+
+			if got := testutil.ToFloat64(allowed) - allowedBefore; got != 1 {
+				t.Errorf("Validate() allowed admission requests metric = %v, want 1", got)
+			}
+
+			// The v1 and v1beta1 AdmissionReview types share the same json layout
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatal(err)
+			}
+
+			if review.APIVersion != tt.apiVersion {
+				t.Errorf("Validate() apiVersion = %v, want %v", review.APIVersion, tt.apiVersion)
+			}
+			if review.Response == nil {
+				t.Fatal("Validate() response is nil")
+			}
+			if review.Response.UID != review.Request.UID {
+				t.Errorf("Validate() response uid = %v, want %v", review.Response.UID, review.Request.UID)
+			}
+			if !review.Response.Allowed {
+				t.Errorf("Validate() not allowed: %v", review.Response.Result)
+			}
+
+			_, err = client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "jupyter-user", metav1.GetOptions{})
+			if !tt.wantNetpolErr(err) {
+				t.Errorf("getting network policy: unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func Test_ValidateWithoutAllowlist(t *testing.T) {
+	existingNetpol := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "jupyter-user",
+			Namespace: "team-a",
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "knep"},
+		},
+	}
+	handler, client := newTestAdmissionHandler(t, k8s.Config{}, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}, existingNetpol)
+
+	body, err := os.ReadFile("testdata/admissionreview-v1-delete.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = bytes.Replace(body, []byte(`"allowlist": "db.nav.no:1521, 1.1.1.1:8080"`), nil, 1)
+
+	client.ClearActions()
+	rec := httptest.NewRecorder()
+	handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if !review.Response.Allowed {
+		t.Errorf("Validate() not allowed: %v", review.Response.Result)
+	}
+
+	// Neither the pod nor its team has an allowlist, so there are no policies to delete
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("Validate() made %v requests for a pod without an allowlist, want none", len(actions))
+	}
+}
+
+func Test_ValidateUnsupportedVersion(t *testing.T) {
+	handler, _ := newTestAdmissionHandler(t, k8s.Config{})
+
+	body := []byte(`{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview","request":{}}`)
+	rec := httptest.NewRecorder()
+	handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Validate() status = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_ValidateDryRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       k8s.Config
+		namespace *corev1.Namespace
+	}{
+		{
+			name:      "global dry-run",
+			cfg:       k8s.Config{DryRun: true},
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		},
+		{
+			name: "namespace dry-run",
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "team-a",
+				Labels: map[string]string{"knep.knada.io/dry-run": "true"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, client := newTestAdmissionHandler(t, tt.cfg, tt.namespace)
+
+			body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatal(err)
+			}
+
+			if !review.Response.Allowed {
+				t.Errorf("Validate() not allowed: %v", review.Response.Result)
+			}
+
+			want := []string{"knep dry-run: would create NetworkPolicy jupyter-user allowing egress to 1.1.1.1:8080, 1.2.3.4:1521"}
+			if diff := cmp.Diff(want, review.Response.Warnings); diff != "" {
+				t.Errorf("Validate() warnings mismatch (-want +got):\n%s", diff)
+			}
+
+			// The dry-run label and team defaults are read from the namespace cache
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "get" && action.GetResource().Resource == "namespaces" {
+					t.Errorf("Validate() read the namespace from the API server, want it read from the cache")
+				}
+			}
+
+			_, err = client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "jupyter-user", metav1.GetOptions{})
+			if !apierrors.IsNotFound(err) {
+				t.Errorf("getting network policy: expected not found, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_ValidateInvalidEntries(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          k8s.Config
+		wantAllowed  bool
+		wantMessage  string
+		wantWarnings []string
+	}{
+		{
+			name:        "deny",
+			cfg:         k8s.Config{InvalidEntryPolicy: k8s.InvalidEntryPolicyDeny},
+			wantAllowed: false,
+			wantMessage: `invalid allowlist entries: "nav.no:abc": invalid port "abc", must be a number between 1 and 65535; "1.2.3": invalid IP address "1.2.3"`,
+		},
+		{
+			name:        "warn",
+			cfg:         k8s.Config{InvalidEntryPolicy: k8s.InvalidEntryPolicyWarn},
+			wantAllowed: true,
+			wantWarnings: []string{
+				`knep: ignoring invalid allowlist entry "nav.no:abc": invalid port "abc", must be a number between 1 and 65535`,
+				`knep: ignoring invalid allowlist entry "1.2.3": invalid IP address "1.2.3"`,
+			},
+		},
+		{
+			name:        "warn by default",
+			wantAllowed: true,
+			wantWarnings: []string{
+				`knep: ignoring invalid allowlist entry "nav.no:abc": invalid port "abc", must be a number between 1 and 65535`,
+				`knep: ignoring invalid allowlist entry "1.2.3": invalid IP address "1.2.3"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestAdmissionHandler(t, tt.cfg, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+
+			body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = bytes.Replace(body, []byte("db.nav.no:1521, 1.1.1.1:8080"), []byte("db.nav.no:1521, nav.no:abc, 1.2.3"), 1)
+
+			rec := httptest.NewRecorder()
+			handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatal(err)
+			}
+
+			if review.Response.Allowed != tt.wantAllowed {
+				t.Errorf("Validate() allowed = %v, want %v", review.Response.Allowed, tt.wantAllowed)
+			}
+			if !tt.wantAllowed && review.Response.Result.Message != tt.wantMessage {
+				t.Errorf("Validate() message = %v, want %v", review.Response.Result.Message, tt.wantMessage)
+			}
+			if diff := cmp.Diff(tt.wantWarnings, review.Response.Warnings); diff != "" {
+				t.Errorf("Validate() warnings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_Mutate(t *testing.T) {
+	handler, _ := newTestAdmissionHandler(t, k8s.Config{})
+
+	body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = bytes.Replace(body, []byte("db.nav.no:1521, 1.1.1.1:8080"), []byte("DB.nav.no:1521, https://google.com/path, 1.1.1.1:8080, db.nav.no:1521"), 1)
+
+	rec := httptest.NewRecorder()
+	handler.Mutate(rec, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+
+	if !review.Response.Allowed {
+		t.Errorf("Mutate() not allowed: %v", review.Response.Result)
+	}
+	if review.Response.PatchType == nil || *review.Response.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Errorf("Mutate() patch type = %v, want %v", review.Response.PatchType, admissionv1.PatchTypeJSONPatch)
+	}
+
+	want := `[` +
+		`{"op":"add","path":"/metadata/annotations/allowlist","value":"db.nav.no:1521,google.com:443,1.1.1.1:8080"},` +
+		`{"op":"add","path":"/metadata/annotations/knep.knada.io~1network-policy","value":"jupyter-user"},` +
+		`{"op":"add","path":"/metadata/annotations/knep.knada.io~1fqdn-network-policy","value":"jupyter-user-fqdn"}` +
+		`]`
+	if diff := cmp.Diff(want, string(review.Response.Patch)); diff != "" {
+		t.Errorf("Mutate() patch mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_MutateReplacesPolicyNames(t *testing.T) {
+	handler, _ := newTestAdmissionHandler(t, k8s.Config{})
+
+	body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userAnnotations := []byte(`"allowlist": "google.com:443",
+          "knep.knada.io/network-policy": "other",
+          "knep.knada.io/fqdn-network-policy": "other-fqdn"`)
+	body = bytes.Replace(body, []byte(`"allowlist": "db.nav.no:1521, 1.1.1.1:8080"`), userAnnotations, 1)
+
+	mutate := func(body []byte) string {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		handler.Mutate(rec, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+			t.Fatal(err)
+		}
+		if !review.Response.Allowed {
+			t.Fatalf("Mutate() not allowed: %v", review.Response.Result)
+		}
+
+		return string(review.Response.Patch)
+	}
+
+	// The pod has no IP entries, so knep manages no network policy for it
+	want := `[` +
+		`{"op":"remove","path":"/metadata/annotations/knep.knada.io~1network-policy"},` +
+		`{"op":"add","path":"/metadata/annotations/knep.knada.io~1fqdn-network-policy","value":"jupyter-user-fqdn"}` +
+		`]`
+	if diff := cmp.Diff(want, mutate(body)); diff != "" {
+		t.Errorf("Mutate() patch mismatch (-want +got):\n%s", diff)
+	}
+
+	// Without a name the policy names are not known yet, and the allowlist hash is only
+	// set with shared DAG run policies
+	body = bytes.Replace(body, []byte(`"name": "jupyter-user",
+        "namespace"`), []byte(`"generateName": "jupyter-",
+        "namespace"`), 1)
+	body = bytes.Replace(body, []byte(`"component": "singleuser-server",`), []byte(`"component": "singleuser-server",
+          "knep.knada.io/allowlist-hash": "0123456789abcdef",`), 1)
+
+	want = `[` +
+		`{"op":"remove","path":"/metadata/annotations/knep.knada.io~1network-policy"},` +
+		`{"op":"remove","path":"/metadata/annotations/knep.knada.io~1fqdn-network-policy"},` +
+		`{"op":"remove","path":"/metadata/labels/knep.knada.io~1allowlist-hash"}` +
+		`]`
+	if diff := cmp.Diff(want, mutate(body)); diff != "" {
+		t.Errorf("Mutate() patch mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_MutateSharedDAGRunPolicies(t *testing.T) {
+	handler, _ := newTestAdmissionHandler(t, k8s.Config{SharedDAGRunPolicies: true})
+
+	body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Airflow task pods are created with generateName, so the name is not known yet
+	body = bytes.Replace(body, []byte(`"name": "jupyter-user",
+        "namespace"`), []byte(`"generateName": "task-",
+        "namespace"`), 1)
+	body = bytes.Replace(body, []byte(`"component": "singleuser-server",
+          "hub.jupyter.org/username": "user"`), []byte(`"dag_id": "dag",
+          "run_id": "run",
+          "task_id": "task"`), 1)
+	body = bytes.Replace(body, []byte("db.nav.no:1521, 1.1.1.1:8080"), []byte("db.nav.no:1521, google.com"), 1)
+
+	rec := httptest.NewRecorder()
+	handler.Mutate(rec, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+
+	var patch []struct {
+		Path  string `json:"path"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(review.Response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{}
+	for _, operation := range patch {
+		values[operation.Path] = operation.Value
+	}
+	if values["/metadata/labels/knep.knada.io~1allowlist-hash"] == "" {
+		t.Errorf("Mutate() patch = %s, want the allowlist hash label", review.Response.Patch)
+	}
+	networkPolicyName := values["/metadata/annotations/knep.knada.io~1network-policy"]
+	if !strings.HasPrefix(networkPolicyName, "dag-") {
+		t.Errorf("Mutate() network policy name = %q, want a name shared by the DAG run", networkPolicyName)
+	}
+	if fqdnNetworkPolicyName := values["/metadata/annotations/knep.knada.io~1fqdn-network-policy"]; fqdnNetworkPolicyName != networkPolicyName+"-fqdn" {
+		t.Errorf("Mutate() fqdn network policy name = %q, want %q", fqdnNetworkPolicyName, networkPolicyName+"-fqdn")
+	}
+
+	// A hash set by the user is removed when there is no allowlist to share policies for
+	body = bytes.Replace(body, []byte(`"task_id": "task"`), []byte(`"task_id": "task",
+          "knep.knada.io/allowlist-hash": "0123456789abcdef"`), 1)
+	body = bytes.Replace(body, []byte("db.nav.no:1521, google.com"), nil, 1)
+
+	rec = httptest.NewRecorder()
+	handler.Mutate(rec, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"op":"remove","path":"/metadata/labels/knep.knada.io~1allowlist-hash"}]`
+	if diff := cmp.Diff(want, string(review.Response.Patch)); diff != "" {
+		t.Errorf("Mutate() patch mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ValidateSharedDAGRunPoliciesHash(t *testing.T) {
+	handler, _ := newTestAdmissionHandler(t, k8s.Config{SharedDAGRunPolicies: true}, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+
+	body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = bytes.Replace(body, []byte(`"component": "singleuser-server",
+          "hub.jupyter.org/username": "user"`), []byte(`"dag_id": "dag",
+          "run_id": "run",
+          "task_id": "task",
+          "knep.knada.io/allowlist-hash": "HASH"`), 1)
+	body = bytes.Replace(body, []byte("db.nav.no:1521, 1.1.1.1:8080"), []byte("db.nav.no:1521"), 1)
+
+	review := func(handle http.HandlerFunc, body []byte) admissionv1.AdmissionReview {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		handle(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+			t.Fatal(err)
+		}
+		return review
+	}
+
+	var patch []struct {
+		Path  string `json:"path"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(review(handler.Mutate, body).Response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	hash := ""
+	for _, operation := range patch {
+		if operation.Path == "/metadata/labels/knep.knada.io~1allowlist-hash" {
+			hash = operation.Value
+		}
+	}
+
+	// A hash not matching the allowlist would select the pod with the policies of other pods
+	if response := review(handler.Validate, body).Response; response.Allowed || !strings.Contains(response.Result.Message, "knep.knada.io/allowlist-hash") {
+		t.Errorf("Validate() allowed = %v, message = %v, want denied for a wrong allowlist hash", response.Allowed, response.Result)
+	}
+
+	if response := review(handler.Validate, bytes.Replace(body, []byte("HASH"), []byte(hash), 1)).Response; !response.Allowed {
+		t.Errorf("Validate() not allowed with the allowlist hash set by Mutate(): %v", response.Result)
+	}
+}
+
+func Test_ValidateUpdate(t *testing.T) {
+	handler, client := newTestAdmissionHandler(t, k8s.Config{}, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+
+	body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respond := func(review admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+		t.Helper()
+
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+
+		var response admissionv1.AdmissionReview
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Response
+	}
+
+	validate := func(review admissionv1.AdmissionReview) {
+		t.Helper()
+
+		if response := respond(review); !response.Allowed {
+			t.Fatalf("Validate() not allowed: %v", response.Result)
+		}
+	}
+
+	var createReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &createReview); err != nil {
+		t.Fatal(err)
+	}
+	validate(createReview)
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(createReview.Request.Object.Raw, &pod); err != nil {
+		t.Fatal(err)
+	}
+
+	updateReview := func(oldAnnotations, annotations map[string]string) admissionv1.AdmissionReview {
+		t.Helper()
+
+		oldPod, updatedPod := pod.DeepCopy(), pod.DeepCopy()
+		oldPod.Annotations, updatedPod.Annotations = oldAnnotations, annotations
+		oldRaw, err := json.Marshal(oldPod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := json.Marshal(updatedPod)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		review := *createReview.DeepCopy()
+		review.Request.Operation = admissionv1.Update
+		review.Request.OldObject = runtime.RawExtension{Raw: oldRaw}
+		review.Request.Object = runtime.RawExtension{Raw: raw}
+		return review
+	}
+
+	validate(updateReview(pod.Annotations, map[string]string{"allowlist": "db.nav.no:1521"}))
+
+	networkPolicy, err := client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "jupyter-user", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrs := []string{}
+	for _, rule := range networkPolicy.Spec.Egress {
+		for _, peer := range rule.To {
+			cidrs = append(cidrs, peer.IPBlock.CIDR)
+		}
+	}
+	if diff := cmp.Diff([]string{"1.2.3.4/32"}, cidrs); diff != "" {
+		t.Errorf("updated network policy peers mismatch (-want +got):\n%s", diff)
+	}
+
+	// The policy names are recorded by the mutating webhook, which only sees pods when created
+	recorded := map[string]string{"allowlist": "db.nav.no:1521", "knep.knada.io/network-policy": "jupyter-user"}
+	changed := map[string]string{"allowlist": "db.nav.no:1521, 1.1.1.1:8080", "knep.knada.io/network-policy": "other"}
+	if response := respond(updateReview(recorded, changed)); response.Allowed {
+		t.Errorf("Validate() allowed changing the recorded network policy name")
+	}
+
+	validate(updateReview(map[string]string{"allowlist": "db.nav.no:1521"}, nil))
+
+	_, err = client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "jupyter-user", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("getting network policy after removing the allowlist: expected not found, got %v", err)
+	}
+}
+
+func Test_ValidateOwnerReferences(t *testing.T) {
+	handler, client := newTestAdmissionHandler(t, k8s.Config{OwnerReferences: true}, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+
+	// The apiserver sets the UID before validating admission, but the pod is not stored yet
+	body, err := os.ReadFile("testdata/admissionreview-v1-create-uid.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(body []byte) []metav1.OwnerReference {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+			t.Fatal(err)
+		}
+		if !review.Response.Allowed {
+			t.Fatalf("Validate() not allowed: %v", review.Response.Result)
+		}
+
+		networkPolicy, err := client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "jupyter-user", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return networkPolicy.OwnerReferences
+	}
+
+	if got := validate(body); len(got) != 0 {
+		t.Errorf("network policy owner references = %v, want none for a pod not stored yet", got)
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil {
+		t.Fatal(err)
+	}
+	review.Request.Operation = admissionv1.Update
+	review.Request.OldObject = review.Request.Object
+	review.Request.Object.Raw = bytes.Replace(review.Request.Object.Raw, []byte("db.nav.no:1521, 1.1.1.1:8080"), []byte("db.nav.no:1521"), 1)
+	body, err = json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: "jupyter-user", UID: "b2c8a1e4-3f6d-4c1a-9e7b-5d2f8a6c4e10"}}
+	if diff := cmp.Diff(want, validate(body)); diff != "" {
+		t.Errorf("network policy owner references after update mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ValidateGuardrails(t *testing.T) {
+	allowlistGuardrails, err := guardrails.Load("testdata/guardrails.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, client := newTestAdmissionHandler(t, k8s.Config{Guardrails: allowlistGuardrails}, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+
+	body, err := os.ReadFile("testdata/admissionreview-v1-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.Validate(rec, httptest.NewRequest(http.MethodPost, "/admission", bytes.NewReader(body)))
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+
+	if review.Response.Allowed {
+		t.Fatal("Validate() allowed a pod violating the guardrails")
+	}
+	want := `allowlist violates platform guardrails: "1.1.1.1:8080": port 8080 is not among the allowed ports`
+	if review.Response.Result.Message != want {
+		t.Errorf("Validate() message = %q, want %q", review.Response.Result.Message, want)
+	}
+
+	_, err = client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "jupyter-user", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("getting network policy: expected not found, got %v", err)
+	}
+}
@@ -1,27 +1,17 @@
 package api
 
 import (
-	"context"
 	"log/slog"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog/v2"
-	"github.com/navikt/knep/pkg/hostmap"
-	"github.com/navikt/knep/pkg/statswriter"
+	"github.com/navikt/knep/pkg/k8s"
 )
 
-func New(ctx context.Context, incluster bool, onpremHostMapFilePath, externalHostMapFilePath string, statisticsChan chan statswriter.AllowListStatistics, log *slog.Logger) (*chi.Mux, error) {
-	hostMap, err := hostmap.New(onpremHostMapFilePath, externalHostMapFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	admissionHandler, err := NewAdmissionHandler(ctx, incluster, hostMap, statisticsChan, log)
-	if err != nil {
-		return nil, err
-	}
+func New(k8sClient *k8s.K8SClient, log *slog.Logger) *chi.Mux {
+	admissionHandler := NewAdmissionHandler(k8sClient, log)
 
 	logger := httplog.NewLogger("api", httplog.Options{
 		JSON:             true,
@@ -35,6 +25,7 @@ func New(ctx context.Context, incluster bool, onpremHostMapFilePath, externalHos
 	router.Use(httplog.RequestLogger(logger))
 	router.Use(middleware.Logger)
 	router.Post("/admission", admissionHandler.Validate)
+	router.Post("/mutate", admissionHandler.Mutate)
 
-	return router, nil
+	return router
 }
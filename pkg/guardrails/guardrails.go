@@ -0,0 +1,345 @@
+package guardrails
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+// Rules restrict what users may put in their allowlists.
+type Rules struct {
+	// ForbiddenCIDRs can not overlap any IP address or CIDR in the allowlist
+	ForbiddenCIDRs []string `yaml:"forbiddenCIDRs"`
+	// MinPrefixLength is the shortest prefix allowed for CIDRs in the allowlist, which
+	// caps how large a network can be allowed, 0 allows any CIDR
+	MinPrefixLength PrefixLengths `yaml:"minPrefixLength"`
+	// ForbiddenDomains are domains or wildcard patterns such as *.example.com
+	ForbiddenDomains []string `yaml:"forbiddenDomains"`
+	// AllowedWildcardSuffixes are the domains wildcard FQDNs may match subdomains of, as
+	// googleapis.com allowing *.googleapis.com and *.storage.googleapis.com. Any wildcard
+	// is allowed when empty
+	AllowedWildcardSuffixes []string `yaml:"allowedWildcardSuffixes"`
+	// AllowedPorts are the ports and port ranges allowlist entries can specify, such as
+	// 443, 8000-9000 or 53/udp. Any port is allowed when empty
+	AllowedPorts []string `yaml:"allowedPorts"`
+	// MaxEntries is the largest number of entries in an allowlist, 0 allows any number
+	MaxEntries int `yaml:"maxEntries"`
+}
+
+type PrefixLengths struct {
+	IPv4 int `yaml:"ipv4"`
+	IPv6 int `yaml:"ipv6"`
+}
+
+type guardrailsFile struct {
+	Global     Rules            `yaml:"global"`
+	Namespaces map[string]Rules `yaml:"namespaces"`
+}
+
+// Guardrails holds the global rules and the rules for single namespaces.
+type Guardrails struct {
+	global     rules
+	namespaces map[string]rules
+}
+
+type rules struct {
+	forbiddenCIDRs          []netip.Prefix
+	minPrefixLength         PrefixLengths
+	forbiddenDomains        []string
+	allowedWildcardSuffixes []string
+	allowedPorts            []hostmap.Port
+	maxEntries              int
+}
+
+// Violation describes how an allowlist entry breaks a guardrail rule. Entry is empty
+// for violations of the allowlist as a whole.
+type Violation struct {
+	Entry  string
+	Rule   string
+	Reason string
+}
+
+func (v Violation) Error() string {
+	if v.Entry == "" {
+		return v.Reason
+	}
+
+	return fmt.Sprintf("%q: %v", v.Entry, v.Reason)
+}
+
+// Violations holds every guardrail violation in an allowlist.
+type Violations []Violation
+
+func (v Violations) Error() string {
+	violations := make([]string, len(v))
+	for i, violation := range v {
+		violations[i] = violation.Error()
+	}
+
+	return "allowlist violates platform guardrails: " + strings.Join(violations, "; ")
+}
+
+// Load reads the guardrails from the file at path. An empty path gives no guardrails.
+func Load(path string) (*Guardrails, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	guardrailsBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+
+	var file guardrailsFile
+	if err := yaml.UnmarshalStrict(guardrailsBytes, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse file %s: %w", path, err)
+	}
+
+	global, err := compile(file.Global)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global guardrails in file %s: %w", path, err)
+	}
+
+	g := &Guardrails{
+		global:     global,
+		namespaces: map[string]rules{},
+	}
+	for namespace, namespaceRules := range file.Namespaces {
+		compiled, err := compile(namespaceRules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid guardrails for namespace %v in file %s: %w", namespace, path, err)
+		}
+		g.namespaces[namespace] = global.merge(compiled)
+	}
+
+	return g, nil
+}
+
+func compile(r Rules) (rules, error) {
+	compiled := rules{
+		minPrefixLength: r.MinPrefixLength,
+		maxEntries:      r.MaxEntries,
+	}
+
+	for _, cidr := range r.ForbiddenCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return rules{}, fmt.Errorf("invalid forbidden CIDR %q: %w", cidr, err)
+		}
+		compiled.forbiddenCIDRs = append(compiled.forbiddenCIDRs, prefix.Masked())
+	}
+
+	for _, domain := range r.ForbiddenDomains {
+		pattern := strings.ToLower(domain)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return rules{}, fmt.Errorf("invalid forbidden domain pattern %q: %w", domain, err)
+		}
+		compiled.forbiddenDomains = append(compiled.forbiddenDomains, pattern)
+	}
+
+	for _, suffix := range r.AllowedWildcardSuffixes {
+		compiled.allowedWildcardSuffixes = append(compiled.allowedWildcardSuffixes, strings.ToLower(strings.TrimPrefix(suffix, ".")))
+	}
+
+	for _, allowedPort := range r.AllowedPorts {
+		port, err := hostmap.ParsePort(allowedPort)
+		if err != nil {
+			return rules{}, fmt.Errorf("invalid allowed port %q: %w", allowedPort, err)
+		}
+		compiled.allowedPorts = append(compiled.allowedPorts, port)
+	}
+
+	return compiled, nil
+}
+
+// merge adds the namespace rules to the global rules. Lists are combined, while limits
+// set for the namespace replace the global ones.
+func (r rules) merge(namespace rules) rules {
+	merged := rules{
+		forbiddenCIDRs:          append(slices.Clone(r.forbiddenCIDRs), namespace.forbiddenCIDRs...),
+		minPrefixLength:         r.minPrefixLength,
+		forbiddenDomains:        append(slices.Clone(r.forbiddenDomains), namespace.forbiddenDomains...),
+		allowedWildcardSuffixes: append(slices.Clone(r.allowedWildcardSuffixes), namespace.allowedWildcardSuffixes...),
+		allowedPorts:            append(slices.Clone(r.allowedPorts), namespace.allowedPorts...),
+		maxEntries:              r.maxEntries,
+	}
+
+	if namespace.minPrefixLength.IPv4 != 0 {
+		merged.minPrefixLength.IPv4 = namespace.minPrefixLength.IPv4
+	}
+	if namespace.minPrefixLength.IPv6 != 0 {
+		merged.minPrefixLength.IPv6 = namespace.minPrefixLength.IPv6
+	}
+	if namespace.maxEntries != 0 {
+		merged.maxEntries = namespace.maxEntries
+	}
+
+	return merged
+}
+
+// Check returns the violations of the guardrails for the namespace by the allowlist
+// entries, or nil if there are none. Entries that can not be parsed are left to the
+// allowlist validation. The ports from the host maps and the default port, as returned
+// by defaultPorts, are always allowed, as the mutating webhook writes them out in the
+// allowlist. With defaultPorts nil, ports are only checked when the entry specifies them.
+func (g *Guardrails) Check(namespace string, entries []string, defaultPorts func(host string) []hostmap.Port) error {
+	if g == nil {
+		return nil
+	}
+
+	r := g.global
+	if namespaceRules, ok := g.namespaces[namespace]; ok {
+		r = namespaceRules
+	}
+
+	var violations Violations
+	entries = hostmap.Normalize(entries)
+	if r.maxEntries > 0 && len(entries) > r.maxEntries {
+		violations = append(violations, Violation{
+			Rule:   "max_entries",
+			Reason: fmt.Sprintf("the allowlist has %v entries, the maximum is %v", len(entries), r.maxEntries),
+		})
+	}
+
+	for _, entry := range entries {
+		host, ports, err := hostmap.ParseEntry(entry)
+		if err != nil {
+			continue
+		}
+
+		violations = append(violations, r.checkHost(entry, host)...)
+		if defaultPorts != nil {
+			ports = slices.DeleteFunc(ports, func(port hostmap.Port) bool {
+				return slices.ContainsFunc(defaultPorts(host), func(defaultPort hostmap.Port) bool {
+					return defaultPort.Contains(port)
+				})
+			})
+		}
+		violations = append(violations, r.checkPorts(entry, ports)...)
+	}
+
+	for _, violation := range violations {
+		metrics.GuardrailViolations.WithLabelValues(violation.Rule).Inc()
+	}
+	if len(violations) > 0 {
+		return violations
+	}
+
+	return nil
+}
+
+func (r rules) checkHost(entry, host string) []Violation {
+	prefix, ok := parsePrefix(host)
+	if !ok {
+		return r.checkDomain(entry, host)
+	}
+
+	var violations []Violation
+	for _, forbidden := range r.forbiddenCIDRs {
+		if forbidden.Overlaps(prefix) {
+			violations = append(violations, Violation{
+				Entry:  entry,
+				Rule:   "forbidden_cidr",
+				Reason: fmt.Sprintf("%v overlaps the forbidden CIDR %v", prefix, forbidden),
+			})
+		}
+	}
+
+	minPrefixLength := r.minPrefixLength.IPv4
+	if prefix.Addr().Is6() {
+		minPrefixLength = r.minPrefixLength.IPv6
+	}
+	if prefix.Bits() < minPrefixLength {
+		violations = append(violations, Violation{
+			Entry:  entry,
+			Rule:   "min_prefix_length",
+			Reason: fmt.Sprintf("CIDR %v is larger than the largest allowed network /%v", prefix, minPrefixLength),
+		})
+	}
+
+	return violations
+}
+
+func (r rules) checkDomain(entry, host string) []Violation {
+	host = strings.ToLower(host)
+	domain, wildcard := strings.CutPrefix(host, "*.")
+	for _, pattern := range r.forbiddenDomains {
+		if matched, _ := path.Match(pattern, host); matched {
+			return []Violation{{
+				Entry:  entry,
+				Rule:   "forbidden_domain",
+				Reason: fmt.Sprintf("%v matches the forbidden domain %v", host, pattern),
+			}}
+		}
+
+		// A wildcard allows every domain below it, so it must not cover a forbidden domain
+		// or the domain of a forbidden wildcard
+		forbidden := strings.TrimPrefix(pattern, "*.")
+		if wildcard && (forbidden == domain || strings.HasSuffix(forbidden, "."+domain)) {
+			return []Violation{{
+				Entry:  entry,
+				Rule:   "forbidden_domain",
+				Reason: fmt.Sprintf("wildcard %v covers the forbidden domain %v", host, pattern),
+			}}
+		}
+	}
+
+	if wildcard && len(r.allowedWildcardSuffixes) > 0 {
+		allowed := slices.ContainsFunc(r.allowedWildcardSuffixes, func(suffix string) bool {
+			return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+		})
+		if !allowed {
+			return []Violation{{
+				Entry:  entry,
+				Rule:   "wildcard_suffix",
+				Reason: fmt.Sprintf("wildcard %v is not below any of the allowed wildcard domains %v", host, strings.Join(r.allowedWildcardSuffixes, ", ")),
+			}}
+		}
+	}
+
+	return nil
+}
+
+func (r rules) checkPorts(entry string, ports []hostmap.Port) []Violation {
+	if len(r.allowedPorts) == 0 {
+		return nil
+	}
+
+	var violations []Violation
+	for _, port := range ports {
+		allowed := slices.ContainsFunc(r.allowedPorts, func(allowedPort hostmap.Port) bool {
+			return allowedPort.Contains(port)
+		})
+		if !allowed {
+			violations = append(violations, Violation{
+				Entry:  entry,
+				Rule:   "allowed_ports",
+				Reason: fmt.Sprintf("port %v is not among the allowed ports", port),
+			})
+		}
+	}
+
+	return violations
+}
+
+// parsePrefix returns the prefix of an IP address or CIDR host, and whether the host
+// is an IP address or CIDR at all.
+func parsePrefix(host string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		return prefix.Masked(), true
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
@@ -0,0 +1,125 @@
+package guardrails
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/hostmap"
+)
+
+func Test_Check(t *testing.T) {
+	g, err := Load("testdata/guardrails.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		namespace    string
+		entries      []string
+		defaultPorts func(host string) []hostmap.Port
+		want         []string
+	}{
+		{
+			name:    "allowed entries",
+			entries: []string{"db.nav.no:1521", "[10.0.0.0/24]", "[2001:db8::/64]:443", "dns.nav.no:53/udp", "app.nav.no:8000-8080"},
+		},
+		{
+			name:    "any network",
+			entries: []string{"[0.0.0.0/0]"},
+			want:    []string{"forbidden_cidr", "min_prefix_length"},
+		},
+		{
+			name:    "metadata server",
+			entries: []string{"169.254.169.254"},
+			want:    []string{"forbidden_cidr"},
+		},
+		{
+			name:    "large ipv6 network",
+			entries: []string{"[2001:db8::/32]"},
+			want:    []string{"min_prefix_length"},
+		},
+		{
+			name:    "forbidden domains",
+			entries: []string{"abc.ONION", "pastebin.com:443", "notpastebin.com"},
+			want:    []string{"forbidden_domain", "forbidden_domain"},
+		},
+		{
+			name:    "wildcards",
+			entries: []string{"*.googleapis.com", "*.storage.googleapis.com", "*.nav.no", "*.evilgoogleapis.com"},
+			want:    []string{"wildcard_suffix", "wildcard_suffix"},
+		},
+		{
+			name:    "wildcards covering forbidden domains",
+			entries: []string{"*.pastebin.com", "*.example.com", "*.tracker.example.org", "*.example.org", "*.other.example.org"},
+			want:    []string{"forbidden_domain", "forbidden_domain", "forbidden_domain", "forbidden_domain", "wildcard_suffix"},
+		},
+		{
+			name:    "ports outside allowed ports",
+			entries: []string{"nav.no:22", "app.nav.no:8000-9001", "dns.nav.no:53"},
+			want:    []string{"allowed_ports", "allowed_ports", "allowed_ports"},
+		},
+		{
+			name:    "ports from the host map",
+			entries: []string{"sftp.nav.no:22", "nav.no:22"},
+			defaultPorts: func(host string) []hostmap.Port {
+				if host == "sftp.nav.no" {
+					return []hostmap.Port{{Number: 22, Protocol: hostmap.ProtocolTCP}}
+				}
+				return []hostmap.Port{{Number: 443, Protocol: hostmap.ProtocolTCP}}
+			},
+			want: []string{"allowed_ports"},
+		},
+		{
+			name:    "too many entries",
+			entries: []string{"a.no", "b.no", "c.no", "d.no", "e.no", "f.no"},
+			want:    []string{"max_entries"},
+		},
+		{
+			name:    "duplicates count once",
+			entries: []string{"a.no", "A.no", "b.no", "c.no", "d.no", "e.no"},
+		},
+		{
+			name:      "namespace rules added to global rules",
+			namespace: "team-db",
+			entries:   []string{"db.nav.no:5432", "db.nav.no:1521", "a.no", "b.no", "c.no", "d.no", "[0.0.0.0/0]:443"},
+			want:      []string{"forbidden_cidr", "min_prefix_length"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace := tt.namespace
+			if namespace == "" {
+				namespace = "team-a"
+			}
+
+			err := g.Check(namespace, tt.entries, tt.defaultPorts)
+
+			var got []string
+			var violations Violations
+			if errors.As(err, &violations) {
+				for _, violation := range violations {
+					got = append(got, violation.Rule)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Check() rules mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_CheckWithoutGuardrails(t *testing.T) {
+	g, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Check("team-a", []string{"[0.0.0.0/0]"}, nil); err != nil {
+		t.Errorf("Check() error = %v, want nil without guardrails", err)
+	}
+}
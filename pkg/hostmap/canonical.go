@@ -0,0 +1,73 @@
+package hostmap
+
+import "strings"
+
+// Canonicalize rewrites allowlist entries into their canonical form: lowercased, with
+// IPv6 addresses shortened and in brackets, without scheme or url path, with an explicit
+// port and without duplicates. Entries without a port get the ports of the host in the
+// host map, or 443. Invalid entries are kept as they are so that Validate can still report them.
+func (h *HostMap) Canonicalize(hosts []string) []string {
+	return canonicalize(hosts, h.current().defaultPorts)
+}
+
+// Normalize rewrites allowlist entries into the canonical form of Canonicalize, except
+// that entries without a port are kept without one. It is used where the host map is
+// not at hand.
+func Normalize(hosts []string) []string {
+	return canonicalize(hosts, nil)
+}
+
+// DefaultPorts returns the ports allowed to a host by an allowlist entry without
+// a port: the ports of the host in the host map, or 443.
+func (h *HostMap) DefaultPorts(host string) []Port {
+	return h.current().defaultPorts(host)
+}
+
+func (m *hostMaps) defaultPorts(host string) []Port {
+	if hostConfig, ok := m.hosts[strings.ToLower(host)]; ok && !isIP(host) && len(hostConfig.ports) > 0 {
+		return hostConfig.ports
+	}
+
+	return []Port{defaultPort}
+}
+
+// canonicalize rewrites the entries into their canonical form, with the ports from
+// defaultPorts for entries without a port. With defaultPorts nil those are kept without one.
+func canonicalize(hosts []string, defaultPorts func(host string) []Port) []string {
+	seen := map[string]bool{}
+	canonical := []string{}
+	for _, hostPort := range hosts {
+		if hostPort == "" {
+			continue
+		}
+
+		entry := hostPort
+		if host, ports, err := ParseEntry(hostPort); err == nil {
+			if len(ports) == 0 && defaultPorts != nil {
+				ports = defaultPorts(host)
+			}
+
+			entry = formatHost(host)
+			if len(ports) > 0 {
+				entry += ":" + formatPorts(ports)
+			}
+		}
+
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		canonical = append(canonical, entry)
+	}
+
+	return canonical
+}
+
+func formatPorts(ports []Port) string {
+	formatted := make([]string, len(ports))
+	for i, port := range ports {
+		formatted[i] = port.String()
+	}
+
+	return strings.Join(formatted, ",")
+}
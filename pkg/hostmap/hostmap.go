@@ -1,12 +1,21 @@
 package hostmap
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"log/slog"
+	"net/netip"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/navikt/knep/pkg/metrics"
 	"gopkg.in/yaml.v2"
 )
 
@@ -21,77 +30,425 @@ type ExternalHost struct {
 }
 
 type AllowIPFQDN struct {
-	IP   map[int32][]string
-	FQDN map[int32][]string
+	IP   map[Port][]string
+	FQDN map[Port][]string
 }
 
+// HostMap resolves allowlist hosts using the onprem and external host maps. The maps
+// are read from file and can be reloaded while the HostMap is in use.
 type HostMap struct {
-	onpremHosts   map[string]OnpremHost
-	externalHosts map[string]ExternalHost
+	onpremHostMapFilePath   string
+	externalHostMapFilePath string
+	config                  Config
+	maps                    atomic.Pointer[hostMaps]
 }
 
-func New(onpremHostMapFilePath, externalHostMapFilePath string) (*HostMap, error) {
-	dataBytes, err := os.ReadFile(onpremHostMapFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file %s: %w", onpremHostMapFilePath, err)
+// PortConflictPolicy decides which ports are allowed when the ports in an allowlist
+// entry are not among the ports of the host in the host map.
+type PortConflictPolicy string
+
+const (
+	// PortConflictPolicyOverride allows only the ports of the entry, overriding the host map.
+	PortConflictPolicyOverride PortConflictPolicy = "override"
+	// PortConflictPolicyReject reports the entry as invalid.
+	PortConflictPolicyReject PortConflictPolicy = "reject"
+	// PortConflictPolicyUnion allows both the ports of the entry and of the host map.
+	PortConflictPolicyUnion PortConflictPolicy = "union"
+)
+
+// Config holds the settings for resolving allowlist entries against the host map.
+type Config struct {
+	// PortConflictPolicy defaults to PortConflictPolicyOverride if unset.
+	PortConflictPolicy PortConflictPolicy
+	// MaxPortRangeSize is the largest number of ports allowed in a port range of an
+	// allowlist entry, defaults to DefaultMaxPortRangeSize if unset.
+	MaxPortRangeSize int
+	// Wildcards allows wildcard FQDNs such as *.example.com, which only some FQDN network
+	// policy backends support.
+	Wildcards bool
+	// FQDNPortRanges allows FQDN entries with port ranges larger than
+	// MaxExpandedPortRangeSize, for FQDN network policy backends that support port ranges.
+	FQDNPortRanges bool
+}
+
+const DefaultMaxPortRangeSize = 1024
+
+// MaxExpandedPortRangeSize is the largest port range of an FQDN entry when the FQDN
+// network policy backend lists every port in a range.
+const MaxExpandedPortRangeSize = 16
+
+// hostMaps is a single loaded version of the host map files, it is never modified
+// after being loaded.
+type hostMaps struct {
+	hosts   map[string]mappedHost
+	version string
+	loaded  time.Time
+}
+
+// mappedHost holds the IPs of a host in the host map and the ports open to it,
+// or no ports if the host map does not specify any.
+type mappedHost struct {
+	ips   []string
+	ports []Port
+}
+
+var defaultPort = Port{Number: 443, Protocol: ProtocolTCP}
+
+func New(onpremHostMapFilePath, externalHostMapFilePath string, cfg Config) (*HostMap, error) {
+	h := &HostMap{
+		onpremHostMapFilePath:   onpremHostMapFilePath,
+		externalHostMapFilePath: externalHostMapFilePath,
+		config:                  cfg,
 	}
 
-	var onpremHostMap map[string]OnpremHost
-	if err := yaml.Unmarshal(dataBytes, &onpremHostMap); err != nil {
+	if _, err := h.Reload(); err != nil {
 		return nil, err
 	}
 
-	dataBytes, err = os.ReadFile(externalHostMapFilePath)
+	return h, nil
+}
+
+// Reload reads the host map files and swaps in the new maps if the files have changed.
+// If the files cannot be read or parsed the maps in use are kept. It returns whether
+// new maps were loaded.
+func (h *HostMap) Reload() (bool, error) {
+	onpremBytes, err := os.ReadFile(h.onpremHostMapFilePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read file %s: %w", h.onpremHostMapFilePath, err)
+	}
+
+	externalBytes, err := os.ReadFile(h.externalHostMapFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file %s: %w", externalHostMapFilePath, err)
+		return false, fmt.Errorf("failed to read file %s: %w", h.externalHostMapFilePath, err)
+	}
+
+	hash := sha256.New()
+	hash.Write(onpremBytes)
+	hash.Write(externalBytes)
+	version := hex.EncodeToString(hash.Sum(nil))[:12]
+	if current := h.maps.Load(); current != nil && current.version == version {
+		return false, nil
+	}
+
+	var onpremHostMap map[string]OnpremHost
+	if err := yaml.Unmarshal(onpremBytes, &onpremHostMap); err != nil {
+		return false, fmt.Errorf("failed to parse file %s: %w", h.onpremHostMapFilePath, err)
 	}
 
 	var externalHostMap map[string]ExternalHost
-	if err := yaml.Unmarshal(dataBytes, &externalHostMap); err != nil {
-		return nil, err
+	if err := yaml.Unmarshal(externalBytes, &externalHostMap); err != nil {
+		return false, fmt.Errorf("failed to parse file %s: %w", h.externalHostMapFilePath, err)
 	}
 
-	return &HostMap{
-		onpremHosts:   onpremHostMap,
-		externalHosts: externalHostMap,
-	}, nil
-}
+	hosts := map[string]mappedHost{}
+	for host, hostConfig := range externalHostMap {
+		mapped, err := newMappedHost(hostConfig.IPs, hostConfig.Port)
+		if err != nil {
+			return false, fmt.Errorf("invalid host %v in file %s: %w", host, h.externalHostMapFilePath, err)
+		}
+		hosts[host] = mapped
+	}
+	// Onprem hosts take precedence over external hosts with the same name
+	for host, hostConfig := range onpremHostMap {
+		mapped, err := newMappedHost(hostConfig.IPs, hostConfig.Port)
+		if err != nil {
+			return false, fmt.Errorf("invalid host %v in file %s: %w", host, h.onpremHostMapFilePath, err)
+		}
+		hosts[host] = mapped
+	}
 
-func (h *HostMap) CreatePortHostMap(hosts []string) (AllowIPFQDN, error) {
-	ipRegex := regexp.MustCompile(`((25[0-5]|(2[0-4]|1\d|[1-9]|)\d)\.?\b){4}`)
-	allow := AllowIPFQDN{
-		IP:   make(map[int32][]string),
-		FQDN: make(map[int32][]string),
+	loaded := &hostMaps{
+		hosts:   hosts,
+		version: version,
+		loaded:  time.Now(),
 	}
+	h.maps.Store(loaded)
+
+	metrics.HostMapInfo.Reset()
+	metrics.HostMapInfo.WithLabelValues(loaded.version).Set(1)
+	metrics.HostMapLoadedTimestamp.Set(float64(loaded.loaded.Unix()))
+
+	return true, nil
+}
 
-	for _, hostPort := range hosts {
-		parts := strings.Split(trimScheme(hostPort), ":")
-		host := strings.Split(parts[0], "/")[0] // Remove host path if present
-		portInts := []int32{443}
-		var err error
-		if len(parts) > 1 {
-			portInts, err = getPorts(parts[1])
+// Watch reloads the host map files at every interval until the context is done.
+// Mounted ConfigMaps are updated in place by the kubelet, so polling picks up changes
+// without restarting the webhook.
+func (h *HostMap) Watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := h.Reload()
 			if err != nil {
-				return AllowIPFQDN{}, err
+				logger.Error("reloading host map, keeping the last good version", "error", err, "version", h.Version())
+				metrics.HostMapReloadFailures.Inc()
+				continue
+			}
+			if reloaded {
+				logger.Info("reloaded host map", "version", h.Version())
 			}
 		}
+	}
+}
 
-		if ipRegex.MatchString(host) {
-			allow.IP = appendPortsHost(allow.IP, portInts, []string{host})
+// Version returns the version of the host maps in use, derived from the content of the files.
+func (h *HostMap) Version() string {
+	return h.current().version
+}
+
+func (h *HostMap) current() *hostMaps {
+	if maps := h.maps.Load(); maps != nil {
+		return maps
+	}
+
+	return &hostMaps{}
+}
+
+// CreatePortHostMap maps the allowlist entries of the pod merged with the team default
+// entries to the hosts allowed per port. Invalid entries are skipped, use Validate to find
+// and report them.
+func (h *HostMap) CreatePortHostMap(hosts, teamHosts []string) (AllowIPFQDN, error) {
+	allow := AllowIPFQDN{
+		IP:   make(map[Port][]string),
+		FQDN: make(map[Port][]string),
+	}
+
+	maps := h.current()
+
+	// Canonicalizing removes the team default entries that the pod already has
+	for _, hostPort := range Normalize(append(slices.Clone(hosts), teamHosts...)) {
+		host, ports, err := ParseEntry(hostPort)
+		if err != nil {
+			continue
+		}
+		if err := h.checkPortRangeSize(ports); err != nil {
+			continue
+		}
+		if err := h.checkWildcard(host); err != nil {
+			continue
+		}
+
+		if isIP(host) {
+			allow.IP = appendPortsHost(allow.IP, withDefaultPort(ports), []string{host})
+		} else if hostConfig, ok := maps.hosts[host]; ok {
+			ports, err := h.resolvePorts(host, ports, hostConfig.ports)
+			if err != nil {
+				continue
+			}
+			allow.IP = appendPortsHost(allow.IP, ports, hostConfig.ips)
 		} else {
-			if hostConfig, ok := h.onpremHosts[host]; ok {
-				allow.IP = appendPortsHost(allow.IP, portInts, hostConfig.IPs)
-			} else if hostConfig, ok := h.externalHosts[host]; ok {
-				allow.IP = appendPortsHost(allow.IP, portInts, hostConfig.IPs)
-			} else {
-				allow.FQDN = appendPortsFQDNHost(allow.FQDN, portInts, host)
+			if err := h.checkFQDNPortRangeSize(ports); err != nil {
+				continue
 			}
+			allow.FQDN = appendPortsHost(allow.FQDN, withDefaultPort(ports), []string{strings.ToLower(host)})
 		}
 	}
 
 	return allow, nil
 }
 
+// resolvePorts returns the ports to allow for a host in the host map. The ports of the
+// host map are used when the entry has none, and the port conflict policy decides when
+// the entry has ports that are not open to the host.
+func (h *HostMap) resolvePorts(host string, entryPorts, mapPorts []Port) ([]Port, error) {
+	if len(mapPorts) == 0 {
+		return withDefaultPort(entryPorts), nil
+	}
+	if len(entryPorts) == 0 {
+		return mapPorts, nil
+	}
+
+	conflicting := slices.ContainsFunc(entryPorts, func(port Port) bool {
+		return !slices.ContainsFunc(mapPorts, func(mapPort Port) bool {
+			return mapPort.Contains(port)
+		})
+	})
+	if !conflicting {
+		return entryPorts, nil
+	}
+
+	switch h.config.PortConflictPolicy {
+	case PortConflictPolicyReject:
+		return nil, fmt.Errorf("port %v is not open to %v, the host map allows port %v", formatPorts(entryPorts), host, formatPorts(mapPorts))
+	case PortConflictPolicyUnion:
+		ports := append(slices.Clone(mapPorts), entryPorts...)
+		slices.SortFunc(ports, ComparePorts)
+		return slices.Compact(ports), nil
+	default:
+		return entryPorts, nil
+	}
+}
+
+// ParseEntry splits an allowlist entry into its host and ports, ignoring any
+// scheme or url path, and returns an error describing why the entry is invalid.
+// The ports are nil if the entry does not specify any.
+func ParseEntry(entry string) (string, []Port, error) {
+	host, port, hasPort, err := splitHostPort(trimScheme(entry))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !hasPort {
+		return host, nil, nil
+	}
+
+	ports, err := getPorts(port)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return host, ports, nil
+}
+
+// splitHostPort splits the host from the port of an entry without scheme. IPv6
+// addresses and CIDRs must be enclosed in brackets when followed by a port, as in
+// [2001:db8::1]:443.
+func splitHostPort(hostPort string) (string, string, bool, error) {
+	if strings.HasPrefix(hostPort, "[") {
+		host, rest, ok := strings.Cut(hostPort[1:], "]")
+		if !ok {
+			return "", "", false, fmt.Errorf("missing closing bracket in IP address %q", hostPort)
+		}
+		if !isIP(host) {
+			return "", "", false, fmt.Errorf("invalid IP address %q", host)
+		}
+
+		switch {
+		case rest == "" || strings.HasPrefix(rest, "/"):
+			return host, "", false, nil
+		case strings.HasPrefix(rest, ":"):
+			return host, rest[1:], true, nil
+		default:
+			return "", "", false, fmt.Errorf("expected [ip] or [ip]:port")
+		}
+	}
+
+	parts := strings.Split(hostPort, ":")
+	if len(parts) > 2 {
+		if isIP(hostPort) {
+			return hostPort, "", false, nil
+		}
+		return "", "", false, fmt.Errorf("expected host or host:port")
+	}
+
+	host, path, _ := strings.Cut(parts[0], "/") // Remove host path if present
+	if looksLikeIP(host) {
+		if !isIP(host) {
+			return "", "", false, fmt.Errorf("invalid IP address %q", host)
+		}
+		cidr, err := withPrefixLength(host, path)
+		if err != nil {
+			return "", "", false, err
+		}
+		host = cidr
+	} else if strings.HasPrefix(host, "*") {
+		if !IsWildcard(host) {
+			return "", "", false, fmt.Errorf("invalid wildcard hostname %q, only a leading *. is supported as in *.example.com", host)
+		}
+	} else if !isValidHostName(host) {
+		return "", "", false, fmt.Errorf("invalid hostname %q", host)
+	}
+
+	if len(parts) == 1 {
+		return host, "", false, nil
+	}
+
+	return host, parts[1], true, nil
+}
+
+// withPrefixLength returns the IP address as a CIDR when the path following it starts
+// with a prefix length, as in 10.0.0.0/24. Other paths are url paths and not part of the host.
+func withPrefixLength(ip, path string) (string, error) {
+	length, _, _ := strings.Cut(path, "/")
+	if length == "" || strings.Trim(length, "0123456789") != "" {
+		return ip, nil
+	}
+
+	cidr := ip + "/" + length
+	if _, err := netip.ParsePrefix(cidr); err != nil {
+		return "", fmt.Errorf("invalid CIDR %q", cidr)
+	}
+
+	return cidr, nil
+}
+
+// checkPortRangeSize returns an error if a port range of an entry is larger than
+// the maximum port range size.
+func (h *HostMap) checkPortRangeSize(ports []Port) error {
+	maxSize := h.config.MaxPortRangeSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxPortRangeSize
+	}
+
+	for _, port := range ports {
+		if port.Size() > maxSize {
+			return fmt.Errorf("port range %v has %v ports, the maximum is %v", port, port.Size(), maxSize)
+		}
+	}
+
+	return nil
+}
+
+// checkFQDNPortRangeSize returns an error if a port range of an FQDN entry is larger
+// than the FQDN network policy backend can list every port of.
+func (h *HostMap) checkFQDNPortRangeSize(ports []Port) error {
+	if h.config.FQDNPortRanges {
+		return nil
+	}
+
+	for _, port := range ports {
+		if port.Size() > MaxExpandedPortRangeSize {
+			return fmt.Errorf("port range %v has %v ports, the FQDN network policy backend allows at most %v ports in a range", port, port.Size(), MaxExpandedPortRangeSize)
+		}
+	}
+
+	return nil
+}
+
+// checkWildcard returns an error if the host is a wildcard FQDN and wildcards are not
+// supported by the FQDN network policy backend.
+func (h *HostMap) checkWildcard(host string) error {
+	if IsWildcard(host) && !h.config.Wildcards {
+		return fmt.Errorf("wildcard FQDN %v is not supported by the FQDN network policy backend", host)
+	}
+
+	return nil
+}
+
+func withDefaultPort(ports []Port) []Port {
+	if len(ports) == 0 {
+		return []Port{defaultPort}
+	}
+
+	return ports
+}
+
+// newMappedHost validates the IPs and parses the port or port range, which may be
+// empty, of a host in the host map.
+func newMappedHost(ips []string, port string) (mappedHost, error) {
+	for _, ip := range ips {
+		if !isIP(ip) {
+			return mappedHost{}, fmt.Errorf("invalid IP address %q", ip)
+		}
+	}
+
+	if port == "" {
+		return mappedHost{ips: ips}, nil
+	}
+
+	ports, err := getPorts(port)
+	if err != nil {
+		return mappedHost{}, err
+	}
+
+	return mappedHost{ips: ips, ports: ports}, nil
+}
+
 func trimScheme(host string) string {
 	parts := strings.Split(host, "//")
 	if len(parts) == 2 {
@@ -101,41 +458,87 @@ func trimScheme(host string) string {
 	return host
 }
 
-func getPorts(ports string) ([]int32, error) {
-	re := regexp.MustCompile(`\b\d+(-\d+)?\b`)
-	ports = re.FindString(ports)
-	if portParts := strings.Split(ports, "-"); len(portParts) == 2 {
-		startPort, err := strconv.Atoi(portParts[0])
-		if err != nil {
-			return []int32{}, err
-		}
-		endPort, err := strconv.Atoi(portParts[1])
-		if err != nil {
-			return []int32{}, err
-		}
+// getPorts parses a port or port range, optionally followed by a protocol suffix
+// as in 514/udp. The protocol defaults to TCP.
+func getPorts(ports string) ([]Port, error) {
+	// Remove url path or query if present, the first path segment can be the protocol
+	ports, path, _ := strings.Cut(ports, "/")
+	ports, _, _ = strings.Cut(ports, "?")
 
-		portInts := []int32{}
-		for port := startPort; port <= endPort; port++ {
-			portInts = append(portInts, int32(port))
-		}
+	protocol := ProtocolTCP
+	suffix, _, _ := strings.Cut(path, "/")
+	suffix, _, _ = strings.Cut(suffix, "?")
+	if suffixProtocol, ok := parseProtocol(suffix); ok {
+		protocol = suffixProtocol
+	}
 
-		return portInts, nil
+	start, end, isRange := strings.Cut(ports, "-")
+	startPort, err := parsePort(start)
+	if err != nil {
+		return []Port{}, err
+	}
+	if !isRange {
+		return []Port{{Number: startPort, Protocol: protocol}}, nil
 	}
 
-	tmp, err := strconv.Atoi(ports)
+	endPort, err := parsePort(end)
 	if err != nil {
-		return []int32{}, err
+		return []Port{}, err
+	}
+	if endPort < startPort {
+		return []Port{}, fmt.Errorf("invalid port range %q, start port is greater than end port", ports)
 	}
 
-	return []int32{int32(tmp)}, nil
+	if endPort == startPort {
+		return []Port{{Number: startPort, Protocol: protocol}}, nil
+	}
+
+	return []Port{{Number: startPort, EndPort: endPort, Protocol: protocol}}, nil
+}
+
+func parsePort(port string) (int32, error) {
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portInt == 0 {
+		return 0, fmt.Errorf("invalid port %q, must be a number between 1 and 65535", port)
+	}
+
+	return int32(portInt), nil
+}
+
+// looksLikeIP reports whether the host is made up of only digits and dots, meaning
+// it was meant as an IP address rather than a hostname.
+func looksLikeIP(host string) bool {
+	r := regexp.MustCompile(`^[\d\.]+$`)
+	return r.MatchString(host)
+}
+
+// isIP reports whether the host is an IPv4 or IPv6 address or CIDR.
+func isIP(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Zone() == ""
+	}
+
+	_, err := netip.ParsePrefix(host)
+	return err == nil
 }
 
-func appendPortsFQDNHost(allow map[int32][]string, portInts []int32, host string) map[int32][]string {
-	if !isValidHostName(host) {
-		return allow
+// formatHost returns the host in its canonical form, with IP addresses and CIDRs in
+// their shortest form and IPv6 addresses and all CIDRs enclosed in brackets.
+func formatHost(host string) string {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.String()
+	} else if prefix, err := netip.ParsePrefix(host); err == nil {
+		host = prefix.String()
+	} else {
+		return strings.ToLower(host)
+	}
+
+	// Without brackets the prefix length of a CIDR would be taken for a url path
+	if strings.ContainsAny(host, ":/") {
+		return "[" + host + "]"
 	}
 
-	return appendPortsHost(allow, portInts, []string{strings.ToLower(host)})
+	return host
 }
 
 func isValidHostName(host string) bool {
@@ -143,9 +546,20 @@ func isValidHostName(host string) bool {
 	return r.MatchString(host)
 }
 
-func appendPortsHost(allow map[int32][]string, portInts []int32, host []string) map[int32][]string {
-	for _, portInt := range portInts {
-		allow[portInt] = append(allow[portInt], host...)
+// IsWildcard reports whether the host is a wildcard FQDN matching every subdomain of a
+// domain, as in *.example.com.
+func IsWildcard(host string) bool {
+	domain, ok := strings.CutPrefix(host, "*.")
+	return ok && isValidHostName(domain)
+}
+
+func appendPortsHost(allow map[Port][]string, ports []Port, hosts []string) map[Port][]string {
+	for _, port := range ports {
+		for _, host := range hosts {
+			if !slices.Contains(allow[port], host) {
+				allow[port] = append(allow[port], host)
+			}
+		}
 	}
 
 	return allow
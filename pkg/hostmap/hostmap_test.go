@@ -1,10 +1,14 @@
 package hostmap
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const (
@@ -51,6 +55,11 @@ informatica.nav.no:
   ips: 
     - "123.123.123.123"
   port: 6005-6010
+dualstack.nav.no:
+  ips:
+    - "10.0.0.1"
+    - "2001:db8:1::/48"
+  port: 5432
 `
 	externalHostYaml = `
 pypi.org:
@@ -60,6 +69,14 @@ pypi.org:
 `
 )
 
+func tcp(port int32) Port {
+	return Port{Number: port, Protocol: ProtocolTCP}
+}
+
+func tcpRange(start, end int32) Port {
+	return Port{Number: start, EndPort: end, Protocol: ProtocolTCP}
+}
+
 func Test_CreatePortHostMap(t *testing.T) {
 	onpremHostMapFile, err := os.CreateTemp("/tmp", "onprem-firewall.yaml")
 	if err != nil {
@@ -83,13 +100,14 @@ func Test_CreatePortHostMap(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	hostMap, err := New(onpremHostMapFile.Name(), externalHostMapFile.Name())
+	hostMap, err := New(onpremHostMapFile.Name(), externalHostMapFile.Name(), Config{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	type args struct {
-		hosts []string
+		hosts     []string
+		teamHosts []string
 	}
 	tests := []struct {
 		name string
@@ -109,13 +127,76 @@ func Test_CreatePortHostMap(t *testing.T) {
 				},
 			},
 			want: AllowIPFQDN{
-				FQDN: map[int32][]string{
-					443: {"google.com", "nav.no"},
+				FQDN: map[Port][]string{
+					tcp(443): {"google.com", "nav.no"},
+				},
+				IP: map[Port][]string{
+					tcp(22):   {"123.123.123.123"},
+					tcp(8080): {"1.1.1.1"},
+					tcp(5432): {"1.2.3.4", "11.22.33.44"},
+				},
+			},
+		},
+		{
+			name: "Test host map port is used when no port is given",
+			args: args{
+				hosts: []string{
+					"db.nav.no",
+					"informatica.nav.no",
+				},
+			},
+			want: AllowIPFQDN{
+				FQDN: map[Port][]string{},
+				IP: map[Port][]string{
+					tcp(1521):            {"1.2.3.4"},
+					tcpRange(6005, 6010): {"123.123.123.123"},
+				},
+			},
+		},
+		{
+			name: "Test IPv6 addresses and CIDRs",
+			args: args{
+				hosts: []string{
+					"[2001:db8::1]:8080",
+					"[2001:DB8:0::2]",
+					"2001:db8::3",
+					"https://[2001:db8::4]:443/path",
+					"[2001:db8:2::/48]:22",
+					"dualstack.nav.no",
+				},
+			},
+			want: AllowIPFQDN{
+				FQDN: map[Port][]string{},
+				IP: map[Port][]string{
+					tcp(22):   {"2001:db8:2::/48"},
+					tcp(443):  {"2001:db8::2", "2001:db8::3", "2001:db8::4"},
+					tcp(5432): {"10.0.0.1", "2001:db8:1::/48"},
+					tcp(8080): {"2001:db8::1"},
+				},
+			},
+		},
+		{
+			name: "Test protocol suffix",
+			args: args{
+				hosts: []string{
+					"syslog.nav.no:514/udp",
+					"10.0.0.53:53/UDP",
+					"10.0.0.53:53",
+					"sctp.nav.no:3868/sctp",
+					"db.nav.no:5432/tcp",
+					"nav.no:8080/path/to/resource",
+				},
+			},
+			want: AllowIPFQDN{
+				FQDN: map[Port][]string{
+					{Number: 514, Protocol: ProtocolUDP}:   {"syslog.nav.no"},
+					{Number: 3868, Protocol: ProtocolSCTP}: {"sctp.nav.no"},
+					tcp(8080):                              {"nav.no"},
 				},
-				IP: map[int32][]string{
-					22:   {"123.123.123.123"},
-					8080: {"1.1.1.1"},
-					5432: {"1.2.3.4", "11.22.33.44"},
+				IP: map[Port][]string{
+					{Number: 53, Protocol: ProtocolUDP}: {"10.0.0.53"},
+					tcp(53):                             {"10.0.0.53"},
+					tcp(5432):                           {"1.2.3.4"},
 				},
 			},
 		},
@@ -128,11 +209,11 @@ func Test_CreatePortHostMap(t *testing.T) {
 				},
 			},
 			want: AllowIPFQDN{
-				FQDN: map[int32][]string{
-					443: {"google.com"},
+				FQDN: map[Port][]string{
+					tcp(443): {"google.com"},
 				},
-				IP: map[int32][]string{
-					22: {"123.123.123.123"},
+				IP: map[Port][]string{
+					tcp(22): {"123.123.123.123"},
 				},
 			},
 		},
@@ -146,12 +227,12 @@ func Test_CreatePortHostMap(t *testing.T) {
 				},
 			},
 			want: AllowIPFQDN{
-				FQDN: map[int32][]string{
-					443: {"google.com"},
+				FQDN: map[Port][]string{
+					tcp(443): {"google.com"},
 				},
-				IP: map[int32][]string{
-					8080: {"1.1.1.1"},
-					1521: {"2.3.4.5", "6.7.8.9", "10.11.12.13", "14.15.16.17", "18.19.20.21", "22.23.24.25", "26.27.28.29"},
+				IP: map[Port][]string{
+					tcp(8080): {"1.1.1.1"},
+					tcp(1521): {"2.3.4.5", "6.7.8.9", "10.11.12.13", "14.15.16.17", "18.19.20.21", "22.23.24.25", "26.27.28.29"},
 				},
 			},
 		},
@@ -164,16 +245,11 @@ func Test_CreatePortHostMap(t *testing.T) {
 				},
 			},
 			want: AllowIPFQDN{
-				FQDN: map[int32][]string{
-					443: {"google.com"},
+				FQDN: map[Port][]string{
+					tcp(443): {"google.com"},
 				},
-				IP: map[int32][]string{
-					6005: {"123.123.123.123"},
-					6006: {"123.123.123.123"},
-					6007: {"123.123.123.123"},
-					6008: {"123.123.123.123"},
-					6009: {"123.123.123.123"},
-					6010: {"123.123.123.123"},
+				IP: map[Port][]string{
+					tcpRange(6005, 6010): {"123.123.123.123"},
 				},
 			},
 		},
@@ -186,11 +262,11 @@ func Test_CreatePortHostMap(t *testing.T) {
 				},
 			},
 			want: AllowIPFQDN{
-				IP: map[int32][]string{
-					443: {"151.101.0.0/16"},
+				IP: map[Port][]string{
+					tcp(443): {"151.101.0.0/16"},
 				},
-				FQDN: map[int32][]string{
-					123: {"google.com"},
+				FQDN: map[Port][]string{
+					tcp(123): {"google.com"},
 				},
 			},
 		},
@@ -204,12 +280,12 @@ func Test_CreatePortHostMap(t *testing.T) {
 				},
 			},
 			want: AllowIPFQDN{
-				IP: map[int32][]string{
-					443:  {"151.101.0.0/16"},
-					1521: {"1.2.3.4"},
+				IP: map[Port][]string{
+					tcp(443):  {"151.101.0.0/16"},
+					tcp(1521): {"1.2.3.4"},
 				},
-				FQDN: map[int32][]string{
-					123: {"google.com"},
+				FQDN: map[Port][]string{
+					tcp(123): {"google.com"},
 				},
 			},
 		},
@@ -224,12 +300,57 @@ func Test_CreatePortHostMap(t *testing.T) {
 				},
 			},
 			want: AllowIPFQDN{
-				FQDN: map[int32][]string{
-					443: {"google.com", "nav.no"},
+				FQDN: map[Port][]string{
+					tcp(443): {"google.com", "nav.no"},
+				},
+				IP: map[Port][]string{
+					tcp(5432):            {"11.22.33.44"},
+					tcpRange(5432, 5433): {"1.2.3.4"},
+				},
+			},
+		},
+		{
+			name: "Test team default entries are merged",
+			args: args{
+				hosts: []string{
+					"google.com",
+					"db.nav.no:1521",
+				},
+				teamHosts: []string{
+					"pypi.org",
+					"Google.com:443",
+					"github.com",
+				},
+			},
+			want: AllowIPFQDN{
+				FQDN: map[Port][]string{
+					tcp(443): {"google.com", "github.com"},
 				},
-				IP: map[int32][]string{
-					5432: {"1.2.3.4", "11.22.33.44"},
-					5433: {"1.2.3.4"},
+				IP: map[Port][]string{
+					tcp(443):  {"151.101.0.0/16"},
+					tcp(1521): {"1.2.3.4"},
+				},
+			},
+		},
+		{
+			name: "Test invalid entries are skipped",
+			args: args{
+				hosts: []string{
+					"google.com",
+					"",
+					"nav.no:abc123",
+					"1.2.3.4.5",
+					"1.1.1.1:8080",
+					"not a host",
+					"example.org:8000-9000",
+				},
+			},
+			want: AllowIPFQDN{
+				FQDN: map[Port][]string{
+					tcp(443): {"google.com"},
+				},
+				IP: map[Port][]string{
+					tcp(8080): {"1.1.1.1"},
 				},
 			},
 		},
@@ -237,7 +358,7 @@ func Test_CreatePortHostMap(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := hostMap.CreatePortHostMap(tt.args.hosts)
+			got, err := hostMap.CreatePortHostMap(tt.args.hosts, tt.args.teamHosts)
 			if err != nil {
 				t.Error(err)
 			}
@@ -248,3 +369,394 @@ func Test_CreatePortHostMap(t *testing.T) {
 		})
 	}
 }
+
+func Test_CreatePortHostMapWildcards(t *testing.T) {
+	hosts := []string{"*.GoogleAPIs.com", "*.nav.no:8443", "nav.no"}
+
+	tests := []struct {
+		name   string
+		config Config
+		want   AllowIPFQDN
+	}{
+		{
+			name:   "Test wildcards supported",
+			config: Config{Wildcards: true},
+			want: AllowIPFQDN{
+				IP: map[Port][]string{},
+				FQDN: map[Port][]string{
+					tcp(443):  {"*.googleapis.com", "nav.no"},
+					tcp(8443): {"*.nav.no"},
+				},
+			},
+		},
+		{
+			name: "Test wildcards not supported",
+			want: AllowIPFQDN{
+				IP: map[Port][]string{},
+				FQDN: map[Port][]string{
+					tcp(443): {"nav.no"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostMap := &HostMap{config: tt.config}
+			got, err := hostMap.CreatePortHostMap(hosts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("CreatePortHostMap() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		hosts  []string
+		want   ValidationErrors
+	}{
+		{
+			name: "Test valid entries",
+			hosts: []string{
+				"google.com",
+				"https://nav.no:443/path/to/resource",
+				"db.nav.no:5432-5433/service",
+				"1.1.1.1:8080",
+				"",
+			},
+		},
+		{
+			name: "Test every invalid entry is reported",
+			hosts: []string{
+				"google.com",
+				"nav.no:abc123",
+				"nav.no:0",
+				"nav.no:70000",
+				"nav.no:6010-6005",
+				"1.2.3.4.5",
+				"256.1.1.1",
+				"*.example.com",
+				"foo.*.example.com",
+				"*example.com",
+				"nav.no:443:443",
+				"[2001:db8::1",
+				"[2001:db8::zz]:443",
+				"2001:db8::1::443",
+				"nav.no:30000-32767",
+				"10.0.0.0/33:443",
+			},
+			want: ValidationErrors{
+				{Entry: "nav.no:abc123", Reason: `invalid port "abc123", must be a number between 1 and 65535`},
+				{Entry: "nav.no:0", Reason: `invalid port "0", must be a number between 1 and 65535`},
+				{Entry: "nav.no:70000", Reason: `invalid port "70000", must be a number between 1 and 65535`},
+				{Entry: "nav.no:6010-6005", Reason: `invalid port range "6010-6005", start port is greater than end port`},
+				{Entry: "1.2.3.4.5", Reason: `invalid IP address "1.2.3.4.5"`},
+				{Entry: "256.1.1.1", Reason: `invalid IP address "256.1.1.1"`},
+				{Entry: "*.example.com", Reason: "wildcard FQDN *.example.com is not supported by the FQDN network policy backend"},
+				{Entry: "foo.*.example.com", Reason: `invalid hostname "foo.*.example.com"`},
+				{Entry: "*example.com", Reason: `invalid wildcard hostname "*example.com", only a leading *. is supported as in *.example.com`},
+				{Entry: "nav.no:443:443", Reason: "expected host or host:port"},
+				{Entry: "[2001:db8::1", Reason: `missing closing bracket in IP address "[2001:db8::1"`},
+				{Entry: "[2001:db8::zz]:443", Reason: `invalid IP address "2001:db8::zz"`},
+				{Entry: "2001:db8::1::443", Reason: "expected host or host:port"},
+				{Entry: "nav.no:30000-32767", Reason: "port range 30000-32767 has 2768 ports, the maximum is 1024"},
+				{Entry: "10.0.0.0/33:443", Reason: `invalid CIDR "10.0.0.0/33"`},
+			},
+		},
+		{
+			name: "Test FQDN port ranges listed port by port by the backend",
+			hosts: []string{
+				"pypi.org:8000-8015",
+				"pypi.org:8000-9000",
+				"1.1.1.1:8000-9000",
+			},
+			want: ValidationErrors{
+				{Entry: "pypi.org:8000-9000", Reason: "port range 8000-9000 has 1001 ports, the FQDN network policy backend allows at most 16 ports in a range"},
+			},
+		},
+		{
+			name:   "Test FQDN port ranges supported by the backend",
+			config: Config{FQDNPortRanges: true},
+			hosts: []string{
+				"pypi.org:8000-9000",
+			},
+		},
+		{
+			name:   "Test wildcards supported by the backend",
+			config: Config{Wildcards: true},
+			hosts: []string{
+				"*.googleapis.com",
+				"*.nav.no:8443",
+				"*.*.nav.no",
+			},
+			want: ValidationErrors{
+				{Entry: "*.*.nav.no", Reason: `invalid wildcard hostname "*.*.nav.no", only a leading *. is supported as in *.example.com`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostMap := &HostMap{config: tt.config}
+			got := hostMap.Validate(tt.hosts)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Validate() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_Canonicalize(t *testing.T) {
+	hosts := []string{
+		"Google.com",
+		"https://nav.no/path/to/resource",
+		"google.com",
+		"nav.no:443",
+		"db.nav.no:05432-5433/service?var=value",
+		"1.1.1.1:8080",
+		"",
+		"google.com:443",
+		"nav.no:abc",
+		"[2001:DB8:0::1]:443",
+		"2001:db8::1",
+		"syslog.nav.no:514/UDP",
+		"syslog.nav.no:514/tcp",
+		"syslog.nav.no:6000-6010/udp?query",
+		"[10.0.0.0/24]:5432",
+		"10.1.0.0/16",
+	}
+
+	want := []string{
+		"google.com:443",
+		"nav.no:443",
+		"db.nav.no:5432-5433",
+		"1.1.1.1:8080",
+		"nav.no:abc",
+		"[2001:db8::1]:443",
+		"syslog.nav.no:514/udp",
+		"syslog.nav.no:514",
+		"syslog.nav.no:6000-6010/udp",
+		"[10.0.0.0/24]:5432",
+		"[10.1.0.0/16]:443",
+		"db.nav.no:1521",
+	}
+
+	hostMap := &HostMap{}
+	hostMap.maps.Store(&hostMaps{hosts: map[string]mappedHost{
+		"db.nav.no": {ips: []string{"10.0.0.1"}, ports: []Port{tcp(1521)}},
+	}})
+	if diff := cmp.Diff(want, hostMap.Canonicalize(append(hosts, "DB.nav.no"))); diff != "" {
+		t.Errorf("Canonicalize() mismatch (-want +got):\n%s", diff)
+	}
+
+	wantNormalized := []string{
+		"google.com",
+		"nav.no",
+		"nav.no:443",
+		"db.nav.no:5432-5433",
+		"1.1.1.1:8080",
+		"google.com:443",
+		"nav.no:abc",
+		"[2001:db8::1]:443",
+		"[2001:db8::1]",
+		"syslog.nav.no:514/udp",
+		"syslog.nav.no:514",
+		"syslog.nav.no:6000-6010/udp",
+		"[10.0.0.0/24]:5432",
+		"[10.1.0.0/16]",
+	}
+
+	if diff := cmp.Diff(wantNormalized, Normalize(hosts)); diff != "" {
+		t.Errorf("Normalize() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ParseEntryCIDRs(t *testing.T) {
+	tests := []struct {
+		entry     string
+		wantHost  string
+		wantPorts []Port
+		wantErr   bool
+	}{
+		{entry: "10.0.0.0/24", wantHost: "10.0.0.0/24"},
+		{entry: "10.0.0.0/24:5432", wantHost: "10.0.0.0/24", wantPorts: []Port{tcp(5432)}},
+		{entry: "[10.0.0.0/24]:5432", wantHost: "10.0.0.0/24", wantPorts: []Port{tcp(5432)}},
+		{entry: "https://1.1.1.1/path", wantHost: "1.1.1.1"},
+		{entry: "10.0.0.0/33", wantErr: true},
+		{entry: "2001:db8::/48", wantHost: "2001:db8::/48"},
+		{entry: "[2001:db8::/48]:5432", wantHost: "2001:db8::/48", wantPorts: []Port{tcp(5432)}},
+		// The port can not be told apart from the address without brackets
+		{entry: "2001:db8::/48:5432", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			host, ports, err := ParseEntry(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost {
+				t.Errorf("ParseEntry() host = %v, want %v", host, tt.wantHost)
+			}
+			if diff := cmp.Diff(tt.wantPorts, ports); diff != "" {
+				t.Errorf("ParseEntry() ports mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_resolvePorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     PortConflictPolicy
+		entryPorts []Port
+		mapPorts   []Port
+		want       []Port
+		wantErr    bool
+	}{
+		{
+			name:     "Test host map port is the default",
+			mapPorts: []Port{tcp(1521)},
+			want:     []Port{tcp(1521)},
+		},
+		{
+			name: "Test default port without host map port",
+			want: []Port{tcp(443)},
+		},
+		{
+			name:       "Test entry port within host map ports",
+			policy:     PortConflictPolicyReject,
+			entryPorts: []Port{tcp(6006)},
+			mapPorts:   []Port{tcpRange(6005, 6010)},
+			want:       []Port{tcp(6006)},
+		},
+		{
+			name:       "Test override",
+			policy:     PortConflictPolicyOverride,
+			entryPorts: []Port{tcp(5432)},
+			mapPorts:   []Port{tcp(1521)},
+			want:       []Port{tcp(5432)},
+		},
+		{
+			name:       "Test reject",
+			policy:     PortConflictPolicyReject,
+			entryPorts: []Port{tcp(5432)},
+			mapPorts:   []Port{tcp(1521)},
+			wantErr:    true,
+		},
+		{
+			name:       "Test union",
+			policy:     PortConflictPolicyUnion,
+			entryPorts: []Port{tcp(5432)},
+			mapPorts:   []Port{tcp(1521)},
+			want:       []Port{tcp(1521), tcp(5432)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostMap := &HostMap{config: Config{PortConflictPolicy: tt.policy}}
+			got, err := hostMap.resolvePorts("db.nav.no", tt.entryPorts, tt.mapPorts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolvePorts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("resolvePorts() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_AllowIPFQDNMarshalJSON(t *testing.T) {
+	allow := AllowIPFQDN{
+		IP: map[Port][]string{
+			tcp(1521):                           {"1.2.3.4"},
+			{Number: 53, Protocol: ProtocolUDP}: {"10.0.0.53"},
+		},
+		FQDN: map[Port][]string{},
+	}
+
+	got, err := json.Marshal(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"IP":{"1521":["1.2.3.4"],"53/udp":["10.0.0.53"]},"FQDN":{}}`
+	if string(got) != want {
+		t.Errorf("json.Marshal() = %s, want %s", got, want)
+	}
+}
+
+func Test_Reload(t *testing.T) {
+	onpremHostMapFile := filepath.Join(t.TempDir(), "onprem-hosts.yaml")
+	if err := os.WriteFile(onpremHostMapFile, []byte(onpremHostYaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	externalHostMapFile := filepath.Join(t.TempDir(), "external-hosts.yaml")
+	if err := os.WriteFile(externalHostMapFile, []byte(externalHostYaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostMap, err := New(onpremHostMapFile, externalHostMapFile, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := hostMap.Reload()
+	if err != nil || reloaded {
+		t.Fatalf("Reload() of unchanged files = %v, %v, want false, nil", reloaded, err)
+	}
+
+	firstVersion := hostMap.Version()
+	updatedYaml := "db.nav.no:\n  port: 1521\n  ips:\n    - \"5.6.7.8\"\n"
+	if err := os.WriteFile(onpremHostMapFile, []byte(updatedYaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err = hostMap.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Reload() of changed files = %v, %v, want true, nil", reloaded, err)
+	}
+	if hostMap.Version() == firstVersion {
+		t.Errorf("Version() = %v, want a new version after reloading", hostMap.Version())
+	}
+	if got := testutil.ToFloat64(metrics.HostMapInfo.WithLabelValues(hostMap.Version())); got != 1 {
+		t.Errorf("hostmap_info for version %v = %v, want 1", hostMap.Version(), got)
+	}
+
+	want := AllowIPFQDN{
+		IP:   map[Port][]string{tcp(1521): {"5.6.7.8"}},
+		FQDN: map[Port][]string{},
+	}
+	got, err := hostMap.CreatePortHostMap([]string{"db.nav.no:1521"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CreatePortHostMap() after reload mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := os.WriteFile(onpremHostMapFile, []byte("db.nav.no: [invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := hostMap.Reload(); err == nil {
+		t.Fatal("Reload() of invalid file returned no error")
+	}
+
+	got, err = hostMap.CreatePortHostMap([]string{"db.nav.no:1521"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CreatePortHostMap() after failed reload mismatch (-want +got):\n%s", diff)
+	}
+}
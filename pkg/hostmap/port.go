@@ -0,0 +1,109 @@
+package hostmap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Protocol is the protocol of an allowed port, with the same values as the
+// protocols of Kubernetes network policies.
+type Protocol string
+
+const (
+	ProtocolTCP  Protocol = "TCP"
+	ProtocolUDP  Protocol = "UDP"
+	ProtocolSCTP Protocol = "SCTP"
+)
+
+// Port is a port number or range together with its protocol.
+type Port struct {
+	Number int32
+	// EndPort is the last port of a range, or zero for a single port.
+	EndPort  int32
+	Protocol Protocol
+}
+
+// Last returns the last port of the range, or the port itself for a single port.
+func (p Port) Last() int32 {
+	if p.EndPort == 0 {
+		return p.Number
+	}
+
+	return p.EndPort
+}
+
+// Size returns the number of ports in the range.
+func (p Port) Size() int {
+	return int(p.Last()-p.Number) + 1
+}
+
+// String returns the port in allowlist syntax, with the protocol as a suffix
+// unless it is TCP, as in 443, 6005-6010 or 514/udp.
+func (p Port) String() string {
+	port := fmt.Sprint(p.Number)
+	if p.EndPort != 0 {
+		port = fmt.Sprintf("%v-%v", p.Number, p.EndPort)
+	}
+
+	if p.Protocol == ProtocolTCP || p.Protocol == "" {
+		return port
+	}
+
+	return fmt.Sprintf("%v/%v", port, strings.ToLower(string(p.Protocol)))
+}
+
+// Contains reports whether all ports of other are within the ports of p.
+func (p Port) Contains(other Port) bool {
+	return p.Protocol == other.Protocol && p.Number <= other.Number && p.Last() >= other.Last()
+}
+
+// ParsePort parses a port or port range with an optional protocol suffix, as in
+// 443, 6005-6010 or 53/udp.
+func ParsePort(port string) (Port, error) {
+	ports, err := getPorts(port)
+	if err != nil {
+		return Port{}, err
+	}
+
+	return ports[0], nil
+}
+
+// MarshalText makes ports usable as JSON object keys.
+func (p Port) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText parses ports written by MarshalText.
+func (p *Port) UnmarshalText(text []byte) error {
+	port, err := ParsePort(string(text))
+	if err != nil {
+		return err
+	}
+
+	*p = port
+	return nil
+}
+
+// parseProtocol returns the protocol for an allowlist protocol suffix, which is
+// case insensitive, and whether the suffix is a protocol at all.
+func parseProtocol(suffix string) (Protocol, bool) {
+	for _, protocol := range []Protocol{ProtocolTCP, ProtocolUDP, ProtocolSCTP} {
+		if strings.EqualFold(suffix, string(protocol)) {
+			return protocol, true
+		}
+	}
+
+	return "", false
+}
+
+// ComparePorts orders ports by number, then end port and protocol.
+func ComparePorts(a, b Port) int {
+	if a.Number != b.Number {
+		return int(a.Number - b.Number)
+	}
+	if a.EndPort != b.EndPort {
+		return int(a.EndPort - b.EndPort)
+	}
+
+	return strings.Compare(string(a.Protocol), string(b.Protocol))
+}
@@ -0,0 +1,75 @@
+package hostmap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EntryError describes why a single allowlist entry is invalid.
+type EntryError struct {
+	Entry  string
+	Reason string
+}
+
+func (e EntryError) Error() string {
+	return fmt.Sprintf("%q: %v", e.Entry, e.Reason)
+}
+
+// ValidationErrors holds an EntryError for every invalid entry in an allowlist.
+type ValidationErrors []EntryError
+
+func (v ValidationErrors) Error() string {
+	entries := make([]string, len(v))
+	for i, entryErr := range v {
+		entries[i] = entryErr.Error()
+	}
+
+	return "invalid allowlist entries: " + strings.Join(entries, "; ")
+}
+
+// Validate checks every allowlist entry and returns the errors for those that
+// are invalid, or nil if all entries are valid.
+func (h *HostMap) Validate(hosts []string) ValidationErrors {
+	var errs ValidationErrors
+	for _, hostPort := range hosts {
+		if hostPort == "" {
+			continue
+		}
+
+		if err := h.validateEntry(hostPort); err != nil {
+			errs = append(errs, EntryError{
+				Entry:  hostPort,
+				Reason: err.Error(),
+			})
+		}
+	}
+
+	return errs
+}
+
+func (h *HostMap) validateEntry(hostPort string) error {
+	host, ports, err := ParseEntry(hostPort)
+	if err != nil {
+		return err
+	}
+
+	if err := h.checkPortRangeSize(ports); err != nil {
+		return err
+	}
+
+	if err := h.checkWildcard(host); err != nil {
+		return err
+	}
+
+	if hostConfig, ok := h.current().hosts[strings.ToLower(host)]; ok {
+		if _, err := h.resolvePorts(host, ports, hostConfig.ports); err != nil {
+			return err
+		}
+	} else if !isIP(host) {
+		if err := h.checkFQDNPortRangeSize(ports); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
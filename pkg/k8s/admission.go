@@ -0,0 +1,26 @@
+package k8s
+
+import (
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type Operation string
+
+const (
+	OperationCreate Operation = "CREATE"
+	OperationUpdate Operation = "UPDATE"
+	OperationDelete Operation = "DELETE"
+)
+
+// AdmissionRequest holds the parts of an admission request knep acts on,
+// independent of the admission.k8s.io API version it was received as.
+type AdmissionRequest struct {
+	UID       types.UID
+	Name      string
+	Namespace string
+	Operation Operation
+	Object    []byte
+	OldObject []byte
+	// DryRun is set when the apiserver will not persist the object
+	DryRun bool
+}
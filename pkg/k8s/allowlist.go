@@ -0,0 +1,154 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+var allowlistResource = schema.GroupVersionResource{
+	Group:    "knep.knada.io",
+	Version:  "v1alpha1",
+	Resource: "allowlists",
+}
+
+const (
+	allowListRefAnnotationKey           = "allowlist-ref"
+	teamDefaultsAnnotationKey           = "allowlist-team-defaults"
+	teamAllowlistNamespaceAnnotationKey = "knep.knada.io/default-allowlist"
+)
+
+type allowlistSpec struct {
+	Entries []allowlistEntry `json:"entries"`
+}
+
+type allowlistEntry struct {
+	Host     string              `json:"host"`
+	Port     *intstr.IntOrString `json:"port,omitempty"`
+	Protocol string              `json:"protocol,omitempty"`
+	Comment  string              `json:"comment,omitempty"`
+}
+
+// allowlistEntries returns the entries of the inline allowlist annotation of the pod
+// merged with the entries of the Allowlist resources it references by name.
+func (k *K8SClient) allowlistEntries(ctx context.Context, pod corev1.Pod) ([]string, error) {
+	hosts := inlineAllowlistEntries(pod)
+
+	refs, ok := pod.Annotations[allowListRefAnnotationKey]
+	if !ok {
+		return hosts, nil
+	}
+
+	for _, name := range strings.Split(strings.ReplaceAll(refs, " ", ""), ",") {
+		if name == "" {
+			continue
+		}
+
+		entries, err := k.getAllowlist(ctx, pod.Namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, entries...)
+	}
+
+	return hosts, nil
+}
+
+func inlineAllowlistEntries(pod corev1.Pod) []string {
+	return splitAllowlist(pod.Annotations[allowListAnnotationKey])
+}
+
+// hasAllowlist reports whether the pod has an allowlist of its own or gets the default
+// allowlist of its team. knep manages no policies for pods without any allowlist.
+func (k *K8SClient) hasAllowlist(ctx context.Context, pod corev1.Pod) (bool, error) {
+	if _, ok := pod.Annotations[allowListAnnotationKey]; ok {
+		return true, nil
+	}
+	if _, ok := pod.Annotations[allowListRefAnnotationKey]; ok {
+		return true, nil
+	}
+
+	teamHosts, err := k.teamAllowlistEntries(ctx, pod)
+	return len(teamHosts) > 0, err
+}
+
+// teamAllowlistEntries returns the default allowlist entries of the team, set as an
+// annotation on the team namespace, unless the pod has opted out of them.
+func (k *K8SClient) teamAllowlistEntries(ctx context.Context, pod corev1.Pod) ([]string, error) {
+	if pod.Annotations[teamDefaultsAnnotationKey] == "false" {
+		return nil, nil
+	}
+
+	ns, err := k.getNamespace(ctx, pod.Namespace)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return splitAllowlist(ns.Annotations[teamAllowlistNamespaceAnnotationKey]), nil
+}
+
+func splitAllowlist(allowList string) []string {
+	hosts := []string{}
+	for _, host := range strings.Split(strings.ReplaceAll(allowList, " ", ""), ",") {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+// getAllowlist returns the entries of the Allowlist resource in the same form as
+// the entries of the inline allowlist annotation.
+func (k *K8SClient) getAllowlist(ctx context.Context, namespace, name string) ([]string, error) {
+	allowlist, err := k.dynamicClient.Resource(allowlistResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("allowlist %v referenced by the %v annotation does not exist in namespace %v", name, allowListRefAnnotationKey, namespace)
+		}
+		return nil, err
+	}
+
+	specObj, ok := allowlist.Object["spec"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("allowlist %v has no spec", name)
+	}
+
+	var spec allowlistSpec
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(specObj, &spec); err != nil {
+		return nil, fmt.Errorf("invalid allowlist %v: %w", name, err)
+	}
+
+	hosts := []string{}
+	for _, entry := range spec.Entries {
+		protocol := strings.ToLower(entry.Protocol)
+		switch protocol {
+		case "", "tcp", "udp", "sctp":
+		default:
+			return nil, fmt.Errorf("invalid allowlist %v: entry %v: unsupported protocol %v", name, entry.Host, entry.Protocol)
+		}
+
+		host := strings.TrimSpace(entry.Host)
+		if entry.Port != nil {
+			host += ":" + entry.Port.String()
+			if protocol != "" && protocol != "tcp" {
+				host += "/" + protocol
+			}
+		} else if protocol != "" && protocol != "tcp" {
+			return nil, fmt.Errorf("invalid allowlist %v: entry %v: protocol %v requires a port", name, entry.Host, entry.Protocol)
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
@@ -0,0 +1,203 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testAllowlist(name string, entries ...map[string]any) *unstructured.Unstructured {
+	specEntries := []any{}
+	for _, entry := range entries {
+		specEntries = append(specEntries, entry)
+	}
+
+	allowlist := &unstructured.Unstructured{}
+	allowlist.SetUnstructuredContent(map[string]any{
+		"apiVersion": "knep.knada.io/v1alpha1",
+		"kind":       "Allowlist",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": "team-a",
+		},
+		"spec": map[string]any{
+			"entries": specEntries,
+		},
+	})
+	return allowlist
+}
+
+func Test_allowlistEntries(t *testing.T) {
+	k := newTestK8SClient(t, nil,
+		testAllowlist("databases",
+			map[string]any{"host": "db.nav.no", "port": int64(1521), "comment": "oracle"},
+			map[string]any{"host": "informatica.nav.no", "port": "6005-6010", "protocol": "TCP"},
+		),
+		testAllowlist("python", map[string]any{"host": "pypi.org"}),
+		testAllowlist("udp", map[string]any{"host": "syslog.nav.no", "port": int64(514), "protocol": "UDP"}),
+		testAllowlist("udp-without-port", map[string]any{"host": "syslog.nav.no", "protocol": "UDP"}),
+		testAllowlist("icmp", map[string]any{"host": "nav.no", "protocol": "ICMP"}),
+	)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name: "inline only",
+			annotations: map[string]string{
+				allowListAnnotationKey: "google.com, nav.no:8080",
+			},
+			want: []string{"google.com", "nav.no:8080"},
+		},
+		{
+			name: "inline merged with referenced allowlists",
+			annotations: map[string]string{
+				allowListAnnotationKey:    "google.com",
+				allowListRefAnnotationKey: "databases, python",
+			},
+			want: []string{"google.com", "db.nav.no:1521", "informatica.nav.no:6005-6010", "pypi.org"},
+		},
+		{
+			name: "missing allowlist",
+			annotations: map[string]string{
+				allowListRefAnnotationKey: "missing",
+			},
+			wantErr: true,
+		},
+		{
+			name: "udp protocol",
+			annotations: map[string]string{
+				allowListRefAnnotationKey: "udp",
+			},
+			want: []string{"syslog.nav.no:514/udp"},
+		},
+		{
+			name: "protocol without port",
+			annotations: map[string]string{
+				allowListRefAnnotationKey: "udp-without-port",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported protocol",
+			annotations: map[string]string{
+				allowListRefAnnotationKey: "icmp",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "pod",
+					Namespace:   "team-a",
+					Annotations: tt.annotations,
+				},
+			}
+
+			got, err := k.allowlistEntries(context.Background(), pod)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("allowlistEntries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("allowlistEntries() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_teamAllowlistEntries(t *testing.T) {
+	k := newTestK8SClient(t, []runtime.Object{
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "team-a",
+				Annotations: map[string]string{
+					teamAllowlistNamespaceAnnotationKey: "pypi.org, github.com:22",
+				},
+			},
+		},
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "team-b",
+			},
+		},
+	})
+
+	tests := []struct {
+		name             string
+		namespace        string
+		annotations      map[string]string
+		want             []string
+		wantHasAllowlist bool
+	}{
+		{
+			name:             "team defaults",
+			namespace:        "team-a",
+			want:             []string{"pypi.org", "github.com:22"},
+			wantHasAllowlist: true,
+		},
+		{
+			name:      "pod opted out",
+			namespace: "team-a",
+			annotations: map[string]string{
+				teamDefaultsAnnotationKey: "false",
+			},
+		},
+		{
+			name:      "namespace without team defaults",
+			namespace: "team-b",
+			want:      []string{},
+		},
+		{
+			name:      "pod allowlist without team defaults",
+			namespace: "team-b",
+			annotations: map[string]string{
+				allowListAnnotationKey: "pypi.org",
+			},
+			want:             []string{},
+			wantHasAllowlist: true,
+		},
+		{
+			name:      "missing namespace",
+			namespace: "team-c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "pod",
+					Namespace:   tt.namespace,
+					Annotations: tt.annotations,
+				},
+			}
+
+			got, err := k.teamAllowlistEntries(context.Background(), pod)
+			if err != nil {
+				t.Fatalf("teamAllowlistEntries() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("teamAllowlistEntries() mismatch (-want +got):\n%s", diff)
+			}
+
+			hasAllowlist, err := k.hasAllowlist(context.Background(), pod)
+			if err != nil {
+				t.Fatalf("hasAllowlist() error = %v", err)
+			}
+			if hasAllowlist != tt.wantHasAllowlist {
+				t.Errorf("hasAllowlist() = %v, want %v", hasAllowlist, tt.wantHasAllowlist)
+			}
+		})
+	}
+}
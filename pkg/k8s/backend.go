@@ -0,0 +1,105 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/navikt/knep/pkg/hostmap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// PolicyBackend creates the policies allowing pods egress to FQDNs. Egress to IP
+// addresses is always allowed with standard network policies, which every backend
+// enforces alongside its own policies.
+type PolicyBackend interface {
+	// Name selects the backend in the configuration
+	Name() string
+	// Kind of the policies, used in logs and metrics
+	Kind() string
+	Resource() schema.GroupVersionResource
+	// SupportsWildcards reports whether the policies can allow egress to wildcard FQDNs
+	// such as *.example.com
+	SupportsWildcards() bool
+	// SupportsPortRanges reports whether the policies can allow a port range in one port,
+	// rather than listing every port in it
+	SupportsPortRanges() bool
+	// CreatesNetworkPolicy reports whether a controller creates a network policy with
+	// the same name for each policy, which knep waits for before admitting the pod
+	CreatesNetworkPolicy() bool
+	// Policy returns the policy allowing the pods matching the pod selector egress to the
+	// FQDNs in the port host map
+	Policy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) (*unstructured.Unstructured, error)
+}
+
+// DefaultPolicyBackend is used when no policy backend is configured.
+const DefaultPolicyBackend = "gke-v1alpha3"
+
+var policyBackends = []PolicyBackend{
+	gkeV1alpha3Backend{},
+	gkeV1alpha1Backend{},
+	ciliumBackend{},
+	calicoBackend{},
+}
+
+// NewPolicyBackend returns the policy backend with the given name.
+func NewPolicyBackend(name string) (PolicyBackend, error) {
+	names := []string{}
+	for _, backend := range policyBackends {
+		if backend.Name() == name {
+			return backend, nil
+		}
+		names = append(names, backend.Name())
+	}
+
+	return nil, fmt.Errorf("unknown policy backend %q, expected one of %v", name, strings.Join(names, ", "))
+}
+
+// newUnstructuredPolicy returns a policy with the metadata knep sets and the given spec.
+func newUnstructuredPolicy(resource schema.GroupVersionResource, kind string, objectMeta metav1.ObjectMeta, spec map[string]any) (*unstructured.Unstructured, error) {
+	// Round trip through JSON so the content only holds JSON types, which makes it
+	// comparable with existing policies and safe to deep copy
+	metadata := map[string]any{
+		"name":      objectMeta.Name,
+		"namespace": objectMeta.Namespace,
+		"labels":    objectMeta.Labels,
+	}
+	if len(objectMeta.OwnerReferences) > 0 {
+		metadata["ownerReferences"] = objectMeta.OwnerReferences
+	}
+
+	content, err := json.Marshal(map[string]any{
+		"apiVersion": resource.GroupVersion().String(),
+		"kind":       kind,
+		"metadata":   metadata,
+		"spec":       spec,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &unstructured.Unstructured{}
+	if err := policy.UnmarshalJSON(content); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// expandPorts lists every port in the port ranges, for policies that do not support
+// endPort.
+func expandPorts(ports []hostmap.Port) []map[string]any {
+	expanded := []map[string]any{}
+	for _, port := range ports {
+		for number := port.Number; number <= port.Last(); number++ {
+			expanded = append(expanded, map[string]any{
+				"protocol": string(port.Protocol),
+				"port":     int64(number),
+			})
+		}
+	}
+
+	return expanded
+}
@@ -0,0 +1,81 @@
+package k8s
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/navikt/knep/pkg/hostmap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var calicoNetpolResource = schema.GroupVersionResource{
+	Group:    "projectcalico.org",
+	Version:  "v3",
+	Resource: "networkpolicies",
+}
+
+// calicoBackend creates Calico network policies with egress rules to domains, which
+// only Calico Enterprise and Calico Cloud support. The domains are set on the rules
+// themselves rather than in a GlobalNetworkSet, which is cluster scoped and would
+// outlive the namespaced policies referencing it.
+type calicoBackend struct{}
+
+func (calicoBackend) Name() string                          { return "calico" }
+func (calicoBackend) Kind() string                          { return "NetworkPolicy.projectcalico.org" }
+func (calicoBackend) Resource() schema.GroupVersionResource { return calicoNetpolResource }
+func (calicoBackend) SupportsWildcards() bool               { return true }
+func (calicoBackend) SupportsPortRanges() bool              { return true }
+func (calicoBackend) CreatesNetworkPolicy() bool            { return false }
+
+func (b calicoBackend) Policy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) (*unstructured.Unstructured, error) {
+	egressRules := []map[string]any{}
+	for _, rule := range groupEgressRules(portHostMap) {
+		// Calico rules match a single protocol, so the ports of a rule are split by protocol
+		protocolPorts := map[hostmap.Protocol][]any{}
+		protocols := []hostmap.Protocol{}
+		for _, port := range rule.ports {
+			if _, ok := protocolPorts[port.Protocol]; !ok {
+				protocols = append(protocols, port.Protocol)
+			}
+			if port.EndPort != 0 {
+				protocolPorts[port.Protocol] = append(protocolPorts[port.Protocol], fmt.Sprintf("%d:%d", port.Number, port.EndPort))
+			} else {
+				protocolPorts[port.Protocol] = append(protocolPorts[port.Protocol], int64(port.Number))
+			}
+		}
+
+		for _, protocol := range protocols {
+			egressRules = append(egressRules, map[string]any{
+				"action":   "Allow",
+				"protocol": string(protocol),
+				"destination": map[string]any{
+					"domains": rule.hosts,
+					"ports":   protocolPorts[protocol],
+				},
+			})
+		}
+	}
+
+	return newUnstructuredPolicy(b.Resource(), "NetworkPolicy", objectMeta, map[string]any{
+		"selector": calicoSelector(podSelector),
+		"types": []string{
+			"Egress",
+		},
+		"egress": egressRules,
+	})
+}
+
+// calicoSelector converts the match labels of the pod selector into a Calico selector
+// expression. Label values can not contain quotes, so they need no escaping.
+func calicoSelector(podSelector metav1.LabelSelector) string {
+	terms := []string{}
+	for key, value := range podSelector.MatchLabels {
+		terms = append(terms, fmt.Sprintf("%v == '%v'", key, value))
+	}
+	slices.Sort(terms)
+
+	return strings.Join(terms, " && ")
+}
@@ -0,0 +1,94 @@
+package k8s
+
+import (
+	"strconv"
+
+	"github.com/navikt/knep/pkg/hostmap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var ciliumNetpolResource = schema.GroupVersionResource{
+	Group:    "cilium.io",
+	Version:  "v2",
+	Resource: "ciliumnetworkpolicies",
+}
+
+// ciliumBackend creates Cilium network policies with toFQDNs rules.
+type ciliumBackend struct{}
+
+func (ciliumBackend) Name() string                          { return "cilium" }
+func (ciliumBackend) Kind() string                          { return "CiliumNetworkPolicy" }
+func (ciliumBackend) Resource() schema.GroupVersionResource { return ciliumNetpolResource }
+func (ciliumBackend) SupportsWildcards() bool               { return true }
+func (ciliumBackend) SupportsPortRanges() bool              { return true }
+func (ciliumBackend) CreatesNetworkPolicy() bool            { return false }
+
+func (b ciliumBackend) Policy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) (*unstructured.Unstructured, error) {
+	// Cilium only learns the IP addresses of FQDNs from DNS lookups passing through its
+	// DNS proxy, which requires a DNS rule in the same policy
+	egressRules := []map[string]any{
+		{
+			"toEndpoints": []map[string]any{
+				{
+					"matchLabels": map[string]string{
+						"k8s:io.kubernetes.pod.namespace": "kube-system",
+						"k8s:k8s-app":                     "kube-dns",
+					},
+				},
+			},
+			"toPorts": []map[string]any{
+				{
+					"ports": []map[string]string{
+						{"port": "53", "protocol": "ANY"},
+					},
+					"rules": map[string]any{
+						"dns": []map[string]string{
+							{"matchPattern": "*"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, rule := range groupEgressRules(portHostMap) {
+		fqdns := []map[string]string{}
+		for _, host := range rule.hosts {
+			if hostmap.IsWildcard(host) {
+				fqdns = append(fqdns, map[string]string{"matchPattern": host})
+			} else {
+				fqdns = append(fqdns, map[string]string{"matchName": host})
+			}
+		}
+
+		ports := []map[string]any{}
+		for _, port := range rule.ports {
+			ciliumPort := map[string]any{
+				"port":     strconv.Itoa(int(port.Number)),
+				"protocol": string(port.Protocol),
+			}
+			if port.EndPort != 0 {
+				ciliumPort["endPort"] = int64(port.EndPort)
+			}
+			ports = append(ports, ciliumPort)
+		}
+
+		egressRules = append(egressRules, map[string]any{
+			"toFQDNs": fqdns,
+			"toPorts": []map[string]any{
+				{
+					"ports": ports,
+				},
+			},
+		})
+	}
+
+	return newUnstructuredPolicy(b.Resource(), b.Kind(), objectMeta, map[string]any{
+		"endpointSelector": map[string]any{
+			"matchLabels": podSelector.MatchLabels,
+		},
+		"egress": egressRules,
+	})
+}
@@ -0,0 +1,95 @@
+package k8s
+
+import (
+	"github.com/navikt/knep/pkg/hostmap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var fqdnNetpolResource = schema.GroupVersionResource{
+	Group:    "networking.gke.io",
+	Version:  "v1alpha3",
+	Resource: "fqdnnetworkpolicies",
+}
+
+var gkeFQDNNetpolResource = schema.GroupVersionResource{
+	Group:    "networking.gke.io",
+	Version:  "v1alpha1",
+	Resource: "fqdnnetworkpolicies",
+}
+
+// gkeV1alpha3Backend creates FQDN network policies for the open source FQDN network
+// policy controller, which creates a network policy with the resolved IP addresses of
+// the FQDNs.
+type gkeV1alpha3Backend struct{}
+
+func (gkeV1alpha3Backend) Name() string                          { return "gke-v1alpha3" }
+func (gkeV1alpha3Backend) Kind() string                          { return "FQDNNetworkPolicy" }
+func (gkeV1alpha3Backend) Resource() schema.GroupVersionResource { return fqdnNetpolResource }
+func (gkeV1alpha3Backend) SupportsWildcards() bool               { return false }
+func (gkeV1alpha3Backend) SupportsPortRanges() bool              { return false }
+func (gkeV1alpha3Backend) CreatesNetworkPolicy() bool            { return true }
+
+func (b gkeV1alpha3Backend) Policy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) (*unstructured.Unstructured, error) {
+	egressRules := []map[string]any{}
+	for _, rule := range groupEgressRules(portHostMap) {
+		// FQDN network policies do not support endPort, so a range is collapsed into
+		// a rule listing every port in it. The host map limits the size of the ranges.
+		egressRules = append(egressRules, map[string]any{
+			"to": []map[string][]string{
+				{
+					"fqdns": rule.hosts,
+				},
+			},
+			"ports": expandPorts(rule.ports),
+		})
+	}
+
+	return newUnstructuredPolicy(b.Resource(), b.Kind(), objectMeta, map[string]any{
+		"podSelector": map[string]any{
+			"matchLabels": podSelector.MatchLabels,
+		},
+		"egress": egressRules,
+		"policyTypes": []string{
+			"Egress",
+		},
+	})
+}
+
+// gkeV1alpha1Backend creates the FQDN network policies built into GKE Dataplane V2,
+// which are enforced directly without a network policy.
+type gkeV1alpha1Backend struct{}
+
+func (gkeV1alpha1Backend) Name() string                          { return "gke-v1alpha1" }
+func (gkeV1alpha1Backend) Kind() string                          { return "FQDNNetworkPolicy" }
+func (gkeV1alpha1Backend) Resource() schema.GroupVersionResource { return gkeFQDNNetpolResource }
+func (gkeV1alpha1Backend) SupportsWildcards() bool               { return true }
+func (gkeV1alpha1Backend) SupportsPortRanges() bool              { return false }
+func (gkeV1alpha1Backend) CreatesNetworkPolicy() bool            { return false }
+
+func (b gkeV1alpha1Backend) Policy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) (*unstructured.Unstructured, error) {
+	egressRules := []map[string]any{}
+	for _, rule := range groupEgressRules(portHostMap) {
+		matches := []map[string]string{}
+		for _, host := range rule.hosts {
+			if hostmap.IsWildcard(host) {
+				matches = append(matches, map[string]string{"pattern": host})
+			} else {
+				matches = append(matches, map[string]string{"name": host})
+			}
+		}
+
+		egressRules = append(egressRules, map[string]any{
+			"matches": matches,
+			"ports":   expandPorts(rule.ports),
+		})
+	}
+
+	return newUnstructuredPolicy(b.Resource(), b.Kind(), objectMeta, map[string]any{
+		"podSelector": map[string]any{
+			"matchLabels": podSelector.MatchLabels,
+		},
+		"egress": egressRules,
+	})
+}
@@ -0,0 +1,236 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/hostmap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testBackendPortHostMap gives a single egress rule with a wildcard, a port range and
+// a UDP port.
+func testBackendPortHostMap() map[hostmap.Port][]string {
+	hosts := []string{"pypi.org", "*.googleapis.com"}
+	return map[hostmap.Port][]string{
+		tcpPort(443): hosts,
+		{Number: 514, Protocol: hostmap.ProtocolUDP}:                 hosts,
+		{Number: 8000, EndPort: 8001, Protocol: hostmap.ProtocolTCP}: hosts,
+	}
+}
+
+// applyBackendPolicy creates the FQDN policy for a pod with the backend through the fake
+// dynamic client, and returns the spec of the created policy.
+func applyBackendPolicy(t *testing.T, backend PolicyBackend, portHostMap map[hostmap.Port][]string) map[string]any {
+	t.Helper()
+
+	k := newTestK8SClientWithConfig(t, Config{PolicyBackend: backend}, nil)
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{
+		Name:      "pod-fqdn",
+		Namespace: "team-a",
+		Labels:    map[string]string{managedByLabelKey: managedByLabelValue},
+	}
+	podSelector := metav1.LabelSelector{MatchLabels: map[string]string{"dag_id": "dag", "task_id": "task"}}
+
+	policy, err := backend.Policy(objectMeta, podSelector, portHostMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.createOrUpdateFQDNNetworkPolicy(ctx, policy, objectMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := k.dynamicClient.Resource(backend.Resource()).Namespace("team-a").Get(ctx, "pod-fqdn", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.GetAPIVersion() != backend.Resource().GroupVersion().String() {
+		t.Errorf("apiVersion = %v, want %v", created.GetAPIVersion(), backend.Resource().GroupVersion())
+	}
+
+	// No pod named pod exists, so the reconciler finds the policy and deletes it as orphaned
+	if err := k.reconcileNamespace(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.dynamicClient.Resource(backend.Resource()).Namespace("team-a").Get(ctx, "pod-fqdn", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("orphaned policy not deleted by the reconciler, error = %v", err)
+	}
+
+	return created.Object["spec"].(map[string]any)
+}
+
+func Test_NewPolicyBackend(t *testing.T) {
+	for _, name := range []string{"gke-v1alpha3", "gke-v1alpha1", "cilium", "calico"} {
+		backend, err := NewPolicyBackend(name)
+		if err != nil {
+			t.Fatalf("NewPolicyBackend(%v) error = %v", name, err)
+		}
+		if backend.Name() != name {
+			t.Errorf("NewPolicyBackend(%v).Name() = %v", name, backend.Name())
+		}
+	}
+
+	if _, err := NewPolicyBackend("antrea"); err == nil {
+		t.Errorf("NewPolicyBackend(antrea) error = nil, want an error")
+	}
+}
+
+func Test_gkeV1alpha3Backend(t *testing.T) {
+	portHostMap := map[hostmap.Port][]string{
+		tcpPort(443): {"pypi.org"},
+		{Number: 8000, EndPort: 8001, Protocol: hostmap.ProtocolTCP}: {"pypi.org"},
+	}
+
+	want := map[string]any{
+		"podSelector": map[string]any{
+			"matchLabels": map[string]any{"dag_id": "dag", "task_id": "task"},
+		},
+		"egress": []any{
+			map[string]any{
+				"to": []any{
+					map[string]any{"fqdns": []any{"pypi.org"}},
+				},
+				"ports": []any{
+					map[string]any{"protocol": "TCP", "port": int64(443)},
+					map[string]any{"protocol": "TCP", "port": int64(8000)},
+					map[string]any{"protocol": "TCP", "port": int64(8001)},
+				},
+			},
+		},
+		"policyTypes": []any{"Egress"},
+	}
+
+	backend := gkeV1alpha3Backend{}
+	if diff := cmp.Diff(want, applyBackendPolicy(t, backend, portHostMap)); diff != "" {
+		t.Errorf("Policy() spec mismatch (-want +got):\n%s", diff)
+	}
+	if backend.SupportsWildcards() || backend.SupportsPortRanges() || !backend.CreatesNetworkPolicy() {
+		t.Errorf("gke-v1alpha3 supports wildcards or port ranges, or does not create network policies")
+	}
+}
+
+func Test_gkeV1alpha1Backend(t *testing.T) {
+	want := map[string]any{
+		"podSelector": map[string]any{
+			"matchLabels": map[string]any{"dag_id": "dag", "task_id": "task"},
+		},
+		"egress": []any{
+			map[string]any{
+				"matches": []any{
+					map[string]any{"pattern": "*.googleapis.com"},
+					map[string]any{"name": "pypi.org"},
+				},
+				"ports": []any{
+					map[string]any{"protocol": "TCP", "port": int64(443)},
+					map[string]any{"protocol": "UDP", "port": int64(514)},
+					map[string]any{"protocol": "TCP", "port": int64(8000)},
+					map[string]any{"protocol": "TCP", "port": int64(8001)},
+				},
+			},
+		},
+	}
+
+	backend := gkeV1alpha1Backend{}
+	if diff := cmp.Diff(want, applyBackendPolicy(t, backend, testBackendPortHostMap())); diff != "" {
+		t.Errorf("Policy() spec mismatch (-want +got):\n%s", diff)
+	}
+	if !backend.SupportsWildcards() || backend.SupportsPortRanges() || backend.CreatesNetworkPolicy() {
+		t.Errorf("gke-v1alpha1 does not support wildcards, supports port ranges or creates network policies")
+	}
+}
+
+func Test_ciliumBackend(t *testing.T) {
+	want := map[string]any{
+		"endpointSelector": map[string]any{
+			"matchLabels": map[string]any{"dag_id": "dag", "task_id": "task"},
+		},
+		"egress": []any{
+			map[string]any{
+				"toEndpoints": []any{
+					map[string]any{
+						"matchLabels": map[string]any{
+							"k8s:io.kubernetes.pod.namespace": "kube-system",
+							"k8s:k8s-app":                     "kube-dns",
+						},
+					},
+				},
+				"toPorts": []any{
+					map[string]any{
+						"ports": []any{
+							map[string]any{"port": "53", "protocol": "ANY"},
+						},
+						"rules": map[string]any{
+							"dns": []any{
+								map[string]any{"matchPattern": "*"},
+							},
+						},
+					},
+				},
+			},
+			map[string]any{
+				"toFQDNs": []any{
+					map[string]any{"matchPattern": "*.googleapis.com"},
+					map[string]any{"matchName": "pypi.org"},
+				},
+				"toPorts": []any{
+					map[string]any{
+						"ports": []any{
+							map[string]any{"port": "443", "protocol": "TCP"},
+							map[string]any{"port": "514", "protocol": "UDP"},
+							map[string]any{"port": "8000", "endPort": int64(8001), "protocol": "TCP"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, applyBackendPolicy(t, ciliumBackend{}, testBackendPortHostMap())); diff != "" {
+		t.Errorf("Policy() spec mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_calicoBackend(t *testing.T) {
+	domains := []any{"*.googleapis.com", "pypi.org"}
+	want := map[string]any{
+		"selector": "dag_id == 'dag' && task_id == 'task'",
+		"types":    []any{"Egress"},
+		"egress": []any{
+			map[string]any{
+				"action":   "Allow",
+				"protocol": "TCP",
+				"destination": map[string]any{
+					"domains": domains,
+					"ports":   []any{int64(443), "8000:8001"},
+				},
+			},
+			map[string]any{
+				"action":   "Allow",
+				"protocol": "UDP",
+				"destination": map[string]any{
+					"domains": domains,
+					"ports":   []any{int64(514)},
+				},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, applyBackendPolicy(t, calicoBackend{}, testBackendPortHostMap())); diff != "" {
+		t.Errorf("Policy() spec mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_backendSkipsWaitingForNetworkPolicy(t *testing.T) {
+	// Only the FQDN network policy controller creates network policies, waiting for one
+	// with another backend would block every pod until the watch times out
+	k := newTestK8SClientWithConfig(t, Config{PolicyBackend: ciliumBackend{}}, nil)
+	objectMeta := metav1.ObjectMeta{Name: "pod-fqdn", Namespace: "team-a"}
+
+	err := k.createOrUpdateFQDNNetworkPolicyWithRetry(context.Background(), objectMeta, metav1.LabelSelector{}, map[hostmap.Port][]string{tcpPort(443): {"pypi.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
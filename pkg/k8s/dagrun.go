@@ -0,0 +1,247 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/workload"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	allowlistHashLabelKey      = "knep.knada.io/allowlist-hash"
+	podReferencesAnnotationKey = "knep.knada.io/pod-references"
+	// A shared policy can be deleted with its last pod before the new pod references it
+	numSharedPolicyAttempts   = 3
+	maxSharedPolicyNameLength = 40
+)
+
+// allowlistHash identifies the computed allowlist of a pod.
+func allowlistHash(hostMap hostmap.AllowIPFQDN) string {
+	hash := sha256.New()
+	for _, portHostMap := range []map[hostmap.Port][]string{hostMap.IP, hostMap.FQDN} {
+		for _, rule := range groupEgressRules(portHostMap) {
+			hash.Write([]byte(strings.Join(rule.hosts, ",") + "/" + joinPorts(rule.ports) + ";"))
+		}
+		hash.Write([]byte("\n"))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// sharedPolicyProfile returns the workload profile of a pod sharing its policies.
+func (k *K8SClient) sharedPolicyProfile(pod corev1.Pod) (workload.Profile, bool) {
+	if !k.config.SharedDAGRunPolicies {
+		return workload.Profile{}, false
+	}
+
+	profile, ok := k.config.Workloads.Match(pod.Labels)
+	return profile, ok && profile.SharesPolicies(pod)
+}
+
+// isSharedPolicyPod reports whether the pod uses policies shared by the pods in its DAG run.
+func (k *K8SClient) isSharedPolicyPod(pod corev1.Pod) bool {
+	_, hashed := pod.Labels[allowlistHashLabelKey]
+	_, ok := k.sharedPolicyProfile(pod)
+	return hashed && ok
+}
+
+// sharedPolicyName returns the name of the network policy shared by the pods in a DAG
+// run with the same allowlist, prefixed with the DAG id for readability.
+func sharedPolicyName(profile workload.Profile, pod corev1.Pod) string {
+	values := []string{}
+	for _, key := range profile.SharedPolicyLabels {
+		values = append(values, pod.Labels[key])
+	}
+	hash := sha256.Sum256([]byte(strings.Join(append(values, pod.Labels[allowlistHashLabelKey]), "\n")))
+
+	prefix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(values[0]))
+	if len(prefix) > maxSharedPolicyNameLength {
+		prefix = prefix[:maxSharedPolicyNameLength]
+	}
+	prefix = strings.Trim(prefix, "-")
+	if prefix == "" {
+		prefix = "dagrun"
+	}
+
+	return prefix + "-" + hex.EncodeToString(hash[:])[:16]
+}
+
+// sharedPodSelector selects the pods in the group of the pod with the same allowlist.
+func sharedPodSelector(profile workload.Profile, pod corev1.Pod) metav1.LabelSelector {
+	matchLabels := map[string]string{
+		allowlistHashLabelKey: pod.Labels[allowlistHashLabelKey],
+	}
+	for _, key := range profile.SharedPolicyLabels {
+		matchLabels[key] = pod.Labels[key]
+	}
+
+	return metav1.LabelSelector{MatchLabels: matchLabels}
+}
+
+// createSharedNetpol creates or updates the shared policies and references the pod from them.
+func (k *K8SClient) createSharedNetpol(ctx context.Context, pod corev1.Pod, objectMeta, fqdnObjectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, hostMap hostmap.AllowIPFQDN) error {
+	var err error
+	for range numSharedPolicyAttempts {
+		if err = k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, hostMap.IP); err != nil {
+			return err
+		}
+		if err = k.createOrUpdateFQDNNetworkPolicyWithRetry(ctx, fqdnObjectMeta, podSelector, hostMap.FQDN); err != nil {
+			return err
+		}
+
+		err = k.addSharedPolicyReferences(ctx, pod, objectMeta.Name, fqdnObjectMeta.Name, hostMap)
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (k *K8SClient) addSharedPolicyReferences(ctx context.Context, pod corev1.Pod, networkPolicyName, fqdnNetworkPolicyName string, hostMap hostmap.AllowIPFQDN) error {
+	addPod := func(references []string) []string {
+		if slices.Contains(references, pod.Name) {
+			return references
+		}
+		return append(references, pod.Name)
+	}
+
+	if len(hostMap.IP) > 0 {
+		if err := updatePodReferences(ctx, k.networkPolicyStore(pod.Namespace), networkPolicyName, addPod); err != nil {
+			return err
+		}
+	}
+
+	if len(hostMap.FQDN) > 0 {
+		if err := updatePodReferences(ctx, k.fqdnNetworkPolicyStore(pod.Namespace), fqdnNetworkPolicyName, addPod); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteSharedNetpol removes the pod from the shared policies, deleting them with the last pod.
+func (k *K8SClient) deleteSharedNetpol(ctx context.Context, pod corev1.Pod) error {
+	removePod := func(references []string) []string {
+		return slices.DeleteFunc(references, func(name string) bool {
+			return name == pod.Name
+		})
+	}
+
+	networkPolicyName, fqdnNetworkPolicyName := k.policyNames(pod)
+	err := updatePodReferences(ctx, k.fqdnNetworkPolicyStore(pod.Namespace), fqdnNetworkPolicyName, removePod)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	err = updatePodReferences(ctx, k.networkPolicyStore(pod.Namespace), networkPolicyName, removePod)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// policyStore reads, patches and deletes the policies of one kind in a namespace.
+type policyStore struct {
+	get    func(ctx context.Context, name string) (metav1.Object, error)
+	patch  func(ctx context.Context, name string, data []byte) error
+	delete func(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+func (k *K8SClient) networkPolicyStore(namespace string) policyStore {
+	networkPolicies := k.client.NetworkingV1().NetworkPolicies(namespace)
+
+	return policyStore{
+		get: func(ctx context.Context, name string) (metav1.Object, error) {
+			return networkPolicies.Get(ctx, name, metav1.GetOptions{})
+		},
+		patch: func(ctx context.Context, name string, data []byte) error {
+			_, err := networkPolicies.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{FieldManager: fieldManager})
+			return err
+		},
+		delete: networkPolicies.Delete,
+	}
+}
+
+func (k *K8SClient) fqdnNetworkPolicyStore(namespace string) policyStore {
+	fqdnNetworkPolicies := k.dynamicClient.Resource(k.config.PolicyBackend.Resource()).Namespace(namespace)
+
+	return policyStore{
+		get: func(ctx context.Context, name string) (metav1.Object, error) {
+			return fqdnNetworkPolicies.Get(ctx, name, metav1.GetOptions{})
+		},
+		patch: func(ctx context.Context, name string, data []byte) error {
+			_, err := fqdnNetworkPolicies.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{FieldManager: fieldManager})
+			return err
+		},
+		delete: func(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+			return fqdnNetworkPolicies.Delete(ctx, name, opts)
+		},
+	}
+}
+
+// updatePodReferences changes the pods referencing a shared policy, deleting it when none are left.
+func updatePodReferences(ctx context.Context, store policyStore, name string, change func(references []string) []string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		policy, err := store.get(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		// Creating the shared policies fails before this on a policy not managed by knep
+		if !isManaged(policy.GetLabels()) {
+			return nil
+		}
+
+		references := change(podReferences(policy))
+		if len(references) == 0 {
+			resourceVersion := policy.GetResourceVersion()
+			return store.delete(ctx, name, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion},
+			})
+		}
+
+		// The resource version makes the patch fail with a conflict if the policy changed
+		slices.Sort(references)
+		data, err := json.Marshal(map[string]any{
+			"metadata": map[string]any{
+				"resourceVersion": policy.GetResourceVersion(),
+				"annotations": map[string]string{
+					podReferencesAnnotationKey: strings.Join(references, ","),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		return store.patch(ctx, name, data)
+	})
+}
+
+// podReferences returns the names of the pods referencing a shared policy.
+func podReferences(policy metav1.Object) []string {
+	references, ok := policy.GetAnnotations()[podReferencesAnnotationKey]
+	if !ok || references == "" {
+		return nil
+	}
+
+	return strings.Split(references, ",")
+}
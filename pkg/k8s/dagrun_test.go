@@ -0,0 +1,166 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/hostmap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testTaskPod(name, runID, hash string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "team-a",
+			Labels: map[string]string{
+				"dag_id":              "My_DAG",
+				"run_id":              runID,
+				"task_id":             name,
+				allowlistHashLabelKey: hash,
+			},
+		},
+	}
+}
+
+func Test_allowlistHash(t *testing.T) {
+	hostMap := hostmap.AllowIPFQDN{
+		IP:   map[hostmap.Port][]string{tcpPort(1521): {"10.0.0.1", "10.0.0.2"}},
+		FQDN: map[hostmap.Port][]string{tcpPort(443): {"pypi.org", "github.com"}},
+	}
+	reordered := hostmap.AllowIPFQDN{
+		IP:   map[hostmap.Port][]string{tcpPort(1521): {"10.0.0.2", "10.0.0.1"}},
+		FQDN: map[hostmap.Port][]string{tcpPort(443): {"github.com", "pypi.org"}},
+	}
+	swapped := hostmap.AllowIPFQDN{
+		IP:   map[hostmap.Port][]string{},
+		FQDN: map[hostmap.Port][]string{tcpPort(1521): {"10.0.0.1", "10.0.0.2"}, tcpPort(443): {"pypi.org", "github.com"}},
+	}
+
+	if allowlistHash(hostMap) != allowlistHash(reordered) {
+		t.Errorf("allowlistHash() differs for the same allowlist in another order")
+	}
+	if allowlistHash(hostMap) == allowlistHash(swapped) {
+		t.Errorf("allowlistHash() is the same for IP and FQDN hosts")
+	}
+}
+
+func Test_sharedPolicyNames(t *testing.T) {
+	first := testTaskPod("extract", "manual__2024-01-01T00:00:00", "abc")
+	second := testTaskPod("load", "manual__2024-01-01T00:00:00", "abc")
+	otherRun := testTaskPod("extract", "manual__2024-01-02T00:00:00", "abc")
+	otherAllowlist := testTaskPod("extract", "manual__2024-01-01T00:00:00", "def")
+	k := newTestK8SClientWithConfig(t, Config{SharedDAGRunPolicies: true}, nil)
+
+	networkPolicyName, fqdnNetworkPolicyName := k.policyNames(first)
+	if otherName, _ := k.policyNames(second); otherName != networkPolicyName {
+		t.Errorf("policyNames() = %v and %v, want the same name for pods in a DAG run", networkPolicyName, otherName)
+	}
+	if otherName, _ := k.policyNames(otherRun); otherName == networkPolicyName {
+		t.Errorf("policyNames() = %v for pods in different DAG runs", otherName)
+	}
+	if otherName, _ := k.policyNames(otherAllowlist); otherName == networkPolicyName {
+		t.Errorf("policyNames() = %v for pods with different allowlists", otherName)
+	}
+	if fqdnNetworkPolicyName != networkPolicyName+"-fqdn" {
+		t.Errorf("policyNames() fqdn = %v, want %v-fqdn", fqdnNetworkPolicyName, networkPolicyName)
+	}
+	if len(networkPolicyName) != len("my-dag-")+16 || networkPolicyName[:7] != "my-dag-" {
+		t.Errorf("policyNames() = %v, want my-dag- followed by a hash", networkPolicyName)
+	}
+
+	// Users can set the allowlist hash label too, so it is ignored unless enabled
+	if name, _ := newTestK8SClient(t, nil).policyNames(first); name != first.Name {
+		t.Errorf("policyNames() = %v with shared DAG run policies disabled, want %v", name, first.Name)
+	}
+
+	podSelector, err := k.createPodSelector(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"dag_id":              "My_DAG",
+		"run_id":              "manual__2024-01-01T00:00:00",
+		allowlistHashLabelKey: "abc",
+	}
+	if diff := cmp.Diff(want, podSelector.MatchLabels); diff != "" {
+		t.Errorf("createPodSelector() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_sharedPolicyReferences(t *testing.T) {
+	k := newTestK8SClientWithConfig(t, Config{SharedDAGRunPolicies: true}, nil)
+	ctx := context.Background()
+	hostMap := hostmap.AllowIPFQDN{
+		IP:   map[hostmap.Port][]string{tcpPort(1521): {"10.0.0.1"}},
+		FQDN: map[hostmap.Port][]string{tcpPort(443): {"pypi.org"}},
+	}
+	first := testTaskPod("extract", "run", "abc")
+	second := testTaskPod("load", "run", "abc")
+
+	networkPolicyName, fqdnNetworkPolicyName := k.policyNames(first)
+	objectMeta := metav1.ObjectMeta{
+		Name:      networkPolicyName,
+		Namespace: "team-a",
+		Labels:    map[string]string{managedByLabelKey: managedByLabelValue},
+	}
+	podSelector, err := k.createPodSelector(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The FQDN network policy is created without waiting for its network policy, as
+	// waiting is covered by createSharedNetpol
+	for _, pod := range []corev1.Pod{first, second} {
+		if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, hostMap.IP); err != nil {
+			t.Fatal(err)
+		}
+		fqdnObjectMeta := *objectMeta.DeepCopy()
+		fqdnObjectMeta.Name = fqdnNetworkPolicyName
+		fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(fqdnObjectMeta, podSelector, hostMap.FQDN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := k.createOrUpdateFQDNNetworkPolicy(ctx, fqdnNetworkPolicy, fqdnObjectMeta); err != nil {
+			t.Fatal(err)
+		}
+		if err := k.addSharedPolicyReferences(ctx, pod, networkPolicyName, fqdnNetworkPolicyName, hostMap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	networkPolicy, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(ctx, networkPolicyName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"extract", "load"}, podReferences(networkPolicy)); diff != "" {
+		t.Errorf("podReferences() mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := k.deleteSharedNetpol(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	networkPolicy, err = k.client.NetworkingV1().NetworkPolicies("team-a").Get(ctx, networkPolicyName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("network policy deleted while referenced by another pod: %v", err)
+	}
+	if diff := cmp.Diff([]string{"load"}, podReferences(networkPolicy)); diff != "" {
+		t.Errorf("podReferences() mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").Get(ctx, fqdnNetworkPolicyName, metav1.GetOptions{}); err != nil {
+		t.Fatalf("fqdn network policy deleted while referenced by another pod: %v", err)
+	}
+
+	if err := k.deleteSharedNetpol(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(ctx, networkPolicyName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("network policy not deleted with the last pod, error = %v", err)
+	}
+	if _, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").Get(ctx, fqdnNetworkPolicyName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("fqdn network policy not deleted with the last pod, error = %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/navikt/knep/pkg/hostmap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const dryRunNamespaceLabelKey = "knep.knada.io/dry-run"
+
+// isDryRun reports whether policies for pods in the namespace should only be computed
+// and reported back, either because dry-run is enabled globally or for the namespace.
+// The namespace is read from the same cache as the team default allowlist.
+func (k *K8SClient) isDryRun(ctx context.Context, namespace string) (bool, error) {
+	if k.config.DryRun {
+		return true, nil
+	}
+
+	ns, err := k.getNamespace(ctx, namespace)
+	if err != nil {
+		return false, err
+	}
+
+	return ns.Labels[dryRunNamespaceLabelKey] == "true", nil
+}
+
+// dryRunNetpol logs the policies that would have been applied for the pod and
+// returns admission warnings describing them, without creating anything.
+func (k *K8SClient) dryRunNetpol(objectMeta, fqdnObjectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, hostMap hostmap.AllowIPFQDN) ([]string, error) {
+	warnings := []string{}
+
+	if len(hostMap.IP) > 0 {
+		networkPolicy, err := k.createNetworkPolicy(objectMeta, podSelector, hostMap.IP)
+		if err != nil {
+			return nil, err
+		}
+
+		k.logger.Info("dry-run, not applying network policy", "namespace", objectMeta.Namespace, "name", networkPolicy.Name, "networkpolicy", networkPolicy)
+		warnings = append(warnings, fmt.Sprintf("knep dry-run: would create NetworkPolicy %v allowing egress to %v", networkPolicy.Name, describeEgress(hostMap.IP)))
+	}
+
+	if len(hostMap.FQDN) > 0 {
+		fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(fqdnObjectMeta, podSelector, hostMap.FQDN)
+		if err != nil {
+			return nil, err
+		}
+
+		k.logger.Info("dry-run, not applying fqdn network policy", "namespace", fqdnObjectMeta.Namespace, "name", fqdnNetworkPolicy.GetName(), "kind", k.config.PolicyBackend.Kind(), "fqdnnetworkpolicy", fqdnNetworkPolicy.Object)
+		warnings = append(warnings, fmt.Sprintf("knep dry-run: would create %v %v allowing egress to %v", k.config.PolicyBackend.Kind(), fqdnNetworkPolicy.GetName(), describeEgress(hostMap.FQDN)))
+	}
+
+	return warnings, nil
+}
+
+func describeEgress(portHostMap map[hostmap.Port][]string) string {
+	entries := []string{}
+	for port, hosts := range portHostMap {
+		for _, host := range hosts {
+			entries = append(entries, fmt.Sprintf("%v:%v", host, port))
+		}
+	}
+	slices.Sort(entries)
+
+	return strings.Join(entries, ", ")
+}
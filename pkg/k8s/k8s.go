@@ -5,24 +5,60 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/navikt/knep/pkg/guardrails"
 	"github.com/navikt/knep/pkg/hostmap"
 	"github.com/navikt/knep/pkg/statswriter"
+	"github.com/navikt/knep/pkg/workload"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 )
 
+type InvalidEntryPolicy string
+
+const (
+	// InvalidEntryPolicyDeny denies pods with invalid allowlist entries
+	InvalidEntryPolicyDeny InvalidEntryPolicy = "deny"
+	// InvalidEntryPolicyWarn allows pods with invalid allowlist entries, ignoring the entries and warning the user
+	InvalidEntryPolicyWarn InvalidEntryPolicy = "warn"
+)
+
+type Config struct {
+	// DryRun computes and reports policies without applying them, for all namespaces
+	DryRun bool
+	// InvalidEntryPolicy defaults to warn when not set, the same as the --invalid-entry-policy flag,
+	// as invalid entries were ignored before they could be denied
+	InvalidEntryPolicy InvalidEntryPolicy
+	// Workloads selects the pods knep creates policies for, defaults to Jupyter and Airflow when not set
+	Workloads workload.Profiles
+	// Guardrails restrict what users may put in their allowlists, no restrictions when not set
+	Guardrails *guardrails.Guardrails
+	// SharedDAGRunPolicies lets Airflow task pods in a DAG run with the same allowlist share their policies
+	SharedDAGRunPolicies bool
+	// PolicyBackend creates the policies allowing egress to FQDNs, defaults to GKE FQDN network policies v1alpha3 when not set
+	PolicyBackend PolicyBackend
+	// OwnerReferences keeps the owner reference from the pod when its policies are applied again, set along with RunOwnerReferencer
+	OwnerReferences bool
+}
+
 type K8SClient struct {
-	hostMap        *hostmap.HostMap
-	statisticsChan chan statswriter.AllowListStatistics
-	client         *kubernetes.Clientset
-	dynamicClient  *dynamic.DynamicClient
-	logger         *slog.Logger
+	config             Config
+	hostMap            *hostmap.HostMap
+	statistics         *statswriter.Queue
+	client             kubernetes.Interface
+	dynamicClient      dynamic.Interface
+	metadataClient     metadata.Interface
+	namespaceInformers informers.SharedInformerFactory
+	namespaces         corelisters.NamespaceLister
+	logger             *slog.Logger
 }
 
-func New(inCluster bool, hostMap *hostmap.HostMap, statisticsChan chan statswriter.AllowListStatistics, logger *slog.Logger) (*K8SClient, error) {
+func New(inCluster bool, cfg Config, hostMap *hostmap.HostMap, statistics *statswriter.Queue, logger *slog.Logger) (*K8SClient, error) {
 	config, err := createKubeConfig(inCluster)
 	if err != nil {
 		return nil, err
@@ -38,13 +74,35 @@ func New(inCluster bool, hostMap *hostmap.HostMap, statisticsChan chan statswrit
 		return nil, err
 	}
 
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithClients(client, dynamicClient, metadataClient, cfg, hostMap, statistics, logger), nil
+}
+
+func NewWithClients(client kubernetes.Interface, dynamicClient dynamic.Interface, metadataClient metadata.Interface, cfg Config, hostMap *hostmap.HostMap, statistics *statswriter.Queue, logger *slog.Logger) *K8SClient {
+	if cfg.Workloads == nil {
+		cfg.Workloads = workload.Defaults()
+	}
+	if cfg.PolicyBackend == nil {
+		cfg.PolicyBackend = gkeV1alpha3Backend{}
+	}
+
+	namespaceInformers := newNamespaceInformerFactory(client)
+
 	return &K8SClient{
-		hostMap:        hostMap,
-		statisticsChan: statisticsChan,
-		client:         client,
-		dynamicClient:  dynamicClient,
-		logger:         logger,
-	}, nil
+		config:             cfg,
+		hostMap:            hostMap,
+		statistics:         statistics,
+		client:             client,
+		dynamicClient:      dynamicClient,
+		metadataClient:     metadataClient,
+		namespaceInformers: namespaceInformers,
+		namespaces:         namespaceInformers.Core().V1().Namespaces().Lister(),
+		logger:             logger,
+	}
 }
 
 func createKubeConfig(inCluster bool) (*rest.Config, error) {
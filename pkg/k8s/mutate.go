@@ -0,0 +1,134 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// MutatePod returns a JSON patch that rewrites the allowlist annotation of the pod into its
+// canonical form and records the names of the policies knep will manage for the pod, or nil
+// if the pod should be left as is. The policy name annotations and the allowlist hash label
+// are only set by knep, any values set by the user are replaced or removed.
+func (k *K8SClient) MutatePod(ctx context.Context, admissionRequest AdmissionRequest) ([]byte, error) {
+	if admissionRequest.Operation != OperationCreate {
+		return nil, nil
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(admissionRequest.Object, &pod); err != nil {
+		k.logger.Error("unmarshalling pod object", "error", err)
+		return nil, err
+	}
+
+	if !k.isRelevantPod(pod.Labels) {
+		return nil, nil
+	}
+
+	annotations := maps.Clone(pod.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	labels := maps.Clone(pod.Labels)
+	delete(annotations, networkPolicyNameAnnotationKey)
+	delete(annotations, fqdnNetworkPolicyNameAnnotationKey)
+	delete(labels, allowlistHashLabelKey)
+
+	if _, ok := pod.Annotations[allowListAnnotationKey]; ok {
+		annotations[allowListAnnotationKey] = strings.Join(k.hostMap.Canonicalize(inlineAllowlistEntries(pod)), ",")
+	}
+
+	_, sharedDAGRunPolicies := k.sharedPolicyProfile(pod)
+
+	// Pods created with generateName get their name after mutation, so the policy names
+	// can only be recorded when the name is set by the client or the policies are shared
+	if pod.Name != "" || sharedDAGRunPolicies {
+		hosts, err := k.allowlistEntries(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+
+		teamHosts, err := k.teamAllowlistEntries(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+
+		hostMap, err := k.hostMap.CreatePortHostMap(hosts, teamHosts)
+		if err != nil {
+			return nil, err
+		}
+
+		if sharedDAGRunPolicies && (len(hostMap.IP) > 0 || len(hostMap.FQDN) > 0) {
+			labels[allowlistHashLabelKey] = allowlistHash(hostMap)
+		}
+
+		mutated := *pod.DeepCopy()
+		mutated.Labels = labels
+		if pod.Name != "" || k.isSharedPolicyPod(mutated) {
+			networkPolicyName, fqdnNetworkPolicyName := k.policyNames(mutated)
+			if len(hostMap.IP) > 0 {
+				annotations[networkPolicyNameAnnotationKey] = networkPolicyName
+			}
+			if len(hostMap.FQDN) > 0 {
+				annotations[fqdnNetworkPolicyNameAnnotationKey] = fqdnNetworkPolicyName
+			}
+		}
+	}
+
+	patch := metadataPatch("annotations", pod.Annotations, annotations, allowListAnnotationKey, networkPolicyNameAnnotationKey, fqdnNetworkPolicyNameAnnotationKey)
+	patch = append(patch, metadataPatch("labels", pod.Labels, labels, allowlistHashLabelKey)...)
+	if len(patch) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(patch)
+}
+
+// metadataPatch returns the operations changing the given keys of the labels or
+// annotations of the pod from their current to their desired values, removing the
+// keys missing from desired.
+func metadataPatch(field string, current, desired map[string]string, keys ...string) []jsonPatchOperation {
+	patch := []jsonPatchOperation{}
+	if current == nil {
+		// Keys can only be added to an existing map, so the map is added with the keys
+		added := map[string]string{}
+		for _, key := range keys {
+			if value, ok := desired[key]; ok {
+				added[key] = value
+			}
+		}
+		if len(added) > 0 {
+			patch = append(patch, jsonPatchOperation{Op: "add", Path: "/metadata/" + field, Value: added})
+		}
+		return patch
+	}
+
+	for _, key := range keys {
+		value, ok := desired[key]
+		currentValue, currentOk := current[key]
+		switch {
+		case !ok && currentOk:
+			patch = append(patch, jsonPatchOperation{Op: "remove", Path: metadataPath(field, key)})
+		case ok && (!currentOk || currentValue != value):
+			patch = append(patch, jsonPatchOperation{Op: "add", Path: metadataPath(field, key), Value: value})
+		}
+	}
+
+	return patch
+}
+
+func metadataPath(field, key string) string {
+	// Escape the key as a JSON pointer, see RFC 6901
+	escapedKey := strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+
+	return "/metadata/" + field + "/" + escapedKey
+}
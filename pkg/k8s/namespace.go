@@ -0,0 +1,62 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+const namespaceInformerResync = 10 * time.Minute
+
+// newNamespaceInformerFactory returns the informer factory caching the namespaces, which
+// are read for the team default allowlist and dry-run label on every admission request.
+func newNamespaceInformerFactory(client kubernetes.Interface) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(client, namespaceInformerResync, informers.WithTransform(stripNamespace))
+}
+
+// StartNamespaceInformer starts caching the namespaces and waits for the cache to fill,
+// which must be done before handling admission requests.
+func (k *K8SClient) StartNamespaceInformer(ctx context.Context) error {
+	k.namespaceInformers.Start(ctx.Done())
+	for informerType, synced := range k.namespaceInformers.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("cache for %v not synced", informerType)
+		}
+	}
+
+	return nil
+}
+
+// getNamespace returns the namespace from the cache. Namespaces missing from it are read
+// from the API server, as a pod can be created right after its namespace.
+func (k *K8SClient) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	ns, err := k.namespaces.Get(name)
+	if apierrors.IsNotFound(err) {
+		return k.client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	}
+
+	return ns, err
+}
+
+// stripNamespace keeps only the namespace metadata in the informer cache to limit memory usage
+func stripNamespace(obj any) (any, error) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return obj, nil
+	}
+
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            ns.Name,
+			ResourceVersion: ns.ResourceVersion,
+			Labels:          ns.Labels,
+			Annotations:     ns.Annotations,
+		},
+	}, nil
+}
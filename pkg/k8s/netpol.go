@@ -4,108 +4,264 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"net/netip"
+	"slices"
 	"time"
 
+	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/metrics"
 	"github.com/navikt/knep/pkg/statswriter"
-	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
+	networkingv1apply "k8s.io/client-go/applyconfigurations/networking/v1"
 )
 
-var fqdnNetpolResource = schema.GroupVersionResource{
-	Group:    "networking.gke.io",
-	Version:  "v1alpha3",
-	Resource: "fqdnnetworkpolicies",
-}
-
 const (
-	allowListAnnotationKey      = "allowlist"
-	jupyterPodLabelKey          = "component"
-	jupyterhubLabelValue        = "singleuser-server"
-	airflowPodLabelKey          = "dag_id"
-	netpolCreatedTimeoutSeconds = 20
-	numFQDNRetries              = 3
+	allowListAnnotationKey             = "allowlist"
+	networkPolicyNameAnnotationKey     = "knep.knada.io/network-policy"
+	fqdnNetworkPolicyNameAnnotationKey = "knep.knada.io/fqdn-network-policy"
+	netpolCreatedTimeoutSeconds        = 20
+	numFQDNRetries                     = 3
+	managedByLabelKey                  = "app.kubernetes.io/managed-by"
+	managedByLabelValue                = "knep"
+	fieldManager                       = "knep"
 )
 
-func (k *K8SClient) AlterNetpol(ctx context.Context, admissionRequest *v1beta1.AdmissionRequest) error {
-	var alterNetpol func(ctx context.Context, pod corev1.Pod) error
+// AlterNetpol creates or deletes the network policies for the pod in the admission
+// request. The returned warnings are passed on to the user in the admission response.
+func (k *K8SClient) AlterNetpol(ctx context.Context, admissionRequest AdmissionRequest) ([]string, error) {
+	defer func(start time.Time) {
+		metrics.AlterNetpolDuration.WithLabelValues(string(admissionRequest.Operation)).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	var alterNetpol func(ctx context.Context, pod corev1.Pod, serverDryRun bool) ([]string, error)
 	var pod corev1.Pod
+	// An update can remove the allowlist, so the old pod is checked too
+	var oldPod *corev1.Pod
 	switch admissionRequest.Operation {
-	case v1beta1.Create:
+	case OperationCreate:
 		alterNetpol = k.createNetpol
-		if err := json.Unmarshal(admissionRequest.Object.Raw, &pod); err != nil {
+		if err := json.Unmarshal(admissionRequest.Object, &pod); err != nil {
 			k.logger.Error("unmarshalling pod object", "error", err)
-			return err
+			return nil, err
+		}
+	case OperationUpdate:
+		oldPod = &corev1.Pod{}
+		if err := json.Unmarshal(admissionRequest.OldObject, oldPod); err != nil {
+			k.logger.Error("unmarshalling pod object", "error", err)
+			return nil, err
 		}
-	case v1beta1.Delete:
+		alterNetpol = func(ctx context.Context, pod corev1.Pod, serverDryRun bool) ([]string, error) {
+			return k.updateNetpol(ctx, *oldPod, pod, serverDryRun)
+		}
+		if err := json.Unmarshal(admissionRequest.Object, &pod); err != nil {
+			k.logger.Error("unmarshalling pod object", "error", err)
+			return nil, err
+		}
+	case OperationDelete:
 		alterNetpol = k.deleteNetpol
-		if err := json.Unmarshal(admissionRequest.OldObject.Raw, &pod); err != nil {
+		if err := json.Unmarshal(admissionRequest.OldObject, &pod); err != nil {
 			k.logger.Error("unmarshalling pod object", "error", err)
-			return err
+			return nil, err
 		}
 	default:
 		k.logger.Info("unsupported request operation %v", "operation", admissionRequest.Operation)
-		return nil
+		return nil, nil
 	}
 
-	if !isRelevantPod(pod.Labels) {
-		return nil
+	if !k.isRelevantPod(pod.Labels) {
+		return nil, nil
 	}
 
-	if _, ok := pod.Annotations[allowListAnnotationKey]; !ok {
-		return nil
+	hasAllowlist, err := k.hasAllowlist(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	if !hasAllowlist && oldPod != nil {
+		if hasAllowlist, err = k.hasAllowlist(ctx, *oldPod); err != nil {
+			return nil, err
+		}
+	}
+	if !hasAllowlist {
+		return nil, nil
+	}
+
+	return alterNetpol(ctx, pod, admissionRequest.DryRun)
+}
+
+func (k *K8SClient) createNetpol(ctx context.Context, pod corev1.Pod, serverDryRun bool) ([]string, error) {
+	return k.applyNetpol(ctx, pod, serverDryRun, false)
+}
+
+// updateNetpol recomputes the network policies of a running pod when its allowlist changes.
+func (k *K8SClient) updateNetpol(ctx context.Context, oldPod, pod corev1.Pod, serverDryRun bool) ([]string, error) {
+	// The mutating webhook only sees pods when they are created
+	if key, changed := changedKey(oldPod.Annotations, pod.Annotations, networkPolicyNameAnnotationKey, fqdnNetworkPolicyNameAnnotationKey); changed {
+		return nil, fmt.Errorf("the %v annotation is set by knep and can not be changed", key)
+	}
+	if key, changed := changedKey(oldPod.Labels, pod.Labels, allowlistHashLabelKey); changed {
+		return nil, fmt.Errorf("the %v label is set by knep and can not be changed", key)
+	}
+
+	if !allowlistChanged(oldPod, pod) {
+		return nil, nil
 	}
 
-	return alterNetpol(ctx, pod)
+	// Shared policies select pods on the allowlist hash set when they were created
+	if k.isSharedPolicyPod(pod) {
+		return []string{"knep: allowlist changes are not applied to pods sharing the network policies of their DAG run"}, nil
+	}
+
+	return k.applyNetpol(ctx, pod, serverDryRun, true)
 }
 
-func (k *K8SClient) createNetpol(ctx context.Context, pod corev1.Pod) error {
-	allowList := pod.Annotations[allowListAnnotationKey]
-	trimmedList := strings.ReplaceAll(allowList, " ", "")
-	hosts := strings.Split(trimmedList, ",")
-	hostMap, err := k.hostMap.CreatePortHostMap(hosts)
+// applyNetpol creates or updates the network policies for the allowlist of the pod.
+func (k *K8SClient) applyNetpol(ctx context.Context, pod corev1.Pod, serverDryRun, update bool) ([]string, error) {
+	hosts, err := k.allowlistEntries(ctx, pod)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	podSelector, err := createPodSelector(pod)
+	teamHosts, err := k.teamAllowlistEntries(ctx, pod)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	objectMeta := metav1.ObjectMeta{
-		Name:      pod.Name,
-		Namespace: pod.Namespace,
-		Labels: map[string]string{
-			"app.kubernetes.io/managed-by": "knep",
-		},
+	// Guardrails are set by the platform and always deny, regardless of the invalid entry policy
+	if err := k.config.Guardrails.Check(pod.Namespace, append(slices.Clone(hosts), teamHosts...), k.hostMap.DefaultPorts); err != nil {
+		return nil, err
+	}
+
+	warnings := []string{}
+	if errs := k.hostMap.Validate(append(slices.Clone(hosts), teamHosts...)); len(errs) > 0 {
+		if k.config.InvalidEntryPolicy == InvalidEntryPolicyDeny {
+			return nil, errs
+		}
+		for _, entryErr := range errs {
+			warnings = append(warnings, fmt.Sprintf("knep: ignoring invalid allowlist entry %v", entryErr.Error()))
+		}
+	}
+
+	hostMap, err := k.hostMap.CreatePortHostMap(hosts, teamHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	// A pod with another hash would be selected by the shared policies of other allowlists
+	if k.isSharedPolicyPod(pod) && pod.Labels[allowlistHashLabelKey] != allowlistHash(hostMap) {
+		return nil, fmt.Errorf("the %v label of pod %v does not match its allowlist", allowlistHashLabelKey, pod.Name)
+	}
+
+	if len(hostMap.IP) == 0 && len(hostMap.FQDN) == 0 && !update {
+		return warnings, nil
+	}
+
+	podSelector, err := k.createPodSelector(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	networkPolicyName, fqdnNetworkPolicyName := k.policyNames(pod)
+	objectMeta := managedObjectMeta(networkPolicyName, pod.Namespace)
+	// A pod being created is not stored yet, so the owner referencer adds its owner reference
+	if k.config.OwnerReferences && update && !k.isSharedPolicyPod(pod) {
+		objectMeta.OwnerReferences = []metav1.OwnerReference{podOwnerReference(pod)}
+	}
+	fqdnObjectMeta := *objectMeta.DeepCopy()
+	fqdnObjectMeta.Name = fqdnNetworkPolicyName
+
+	if serverDryRun {
+		dryRunWarnings, err := k.dryRunNetpol(objectMeta, fqdnObjectMeta, podSelector, hostMap)
+		return append(warnings, dryRunWarnings...), err
+	}
+
+	service, team := k.serviceAndTeam(pod)
+	k.statistics.Send(statswriter.AllowListStatistics{
+		HostMap:     hostMap,
+		Pod:         pod,
+		Service:     service,
+		Team:        team,
+		PodEntries:  hosts,
+		TeamEntries: teamHosts,
+	})
+
+	dryRun, err := k.isDryRun(ctx, pod.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		dryRunWarnings, err := k.dryRunNetpol(objectMeta, fqdnObjectMeta, podSelector, hostMap)
+		return append(warnings, dryRunWarnings...), err
 	}
 
-	k.statisticsChan <- statswriter.AllowListStatistics{
-		HostMap: hostMap,
-		Pod:     pod,
+	if k.isSharedPolicyPod(pod) {
+		if err := k.createSharedNetpol(ctx, pod, objectMeta, fqdnObjectMeta, podSelector, hostMap); err != nil {
+			return nil, err
+		}
+		return warnings, nil
 	}
 
 	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, hostMap.IP); err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := k.createOrUpdateFQDNNetworkPolicyWithRetry(ctx, objectMeta, podSelector, hostMap.FQDN); err != nil {
-		return err
+	if err := k.createOrUpdateFQDNNetworkPolicyWithRetry(ctx, fqdnObjectMeta, podSelector, hostMap.FQDN); err != nil {
+		return nil, err
+	}
+
+	if update {
+		if err := k.deleteUnusedPolicies(ctx, pod.Namespace, networkPolicyName, fqdnNetworkPolicyName, hostMap); err != nil {
+			return nil, err
+		}
+	}
+
+	return warnings, nil
+}
+
+// deleteUnusedPolicies deletes the policies of a pod that no longer have any hosts.
+func (k *K8SClient) deleteUnusedPolicies(ctx context.Context, namespace, networkPolicyName, fqdnNetworkPolicyName string, hostMap hostmap.AllowIPFQDN) error {
+	if len(hostMap.FQDN) == 0 {
+		if err := k.deleteManagedFQDNNetworkPolicy(ctx, namespace, fqdnNetworkPolicyName); err != nil {
+			return err
+		}
+	}
+
+	if len(hostMap.IP) == 0 {
+		if err := k.deleteManagedNetworkPolicy(ctx, namespace, networkPolicyName); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (k *K8SClient) createOrUpdateNetworkPolicy(ctx context.Context, objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[int32][]string) error {
+// allowlistChanged reports whether the annotations the allowlist is computed from changed.
+func allowlistChanged(oldPod, pod corev1.Pod) bool {
+	_, changed := changedKey(oldPod.Annotations, pod.Annotations, allowListAnnotationKey, allowListRefAnnotationKey, teamDefaultsAnnotationKey)
+	return changed
+}
+
+// changedKey returns the first of the keys whose value differs between old and new.
+func changedKey(oldValues, values map[string]string, keys ...string) (string, bool) {
+	for _, key := range keys {
+		oldValue, oldOk := oldValues[key]
+		value, ok := values[key]
+		if oldOk != ok || oldValue != value {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+func (k *K8SClient) createOrUpdateNetworkPolicy(ctx context.Context, objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) error {
 	if len(portHostMap) == 0 {
 		return nil
 	}
@@ -115,32 +271,59 @@ func (k *K8SClient) createOrUpdateNetworkPolicy(ctx context.Context, objectMeta
 		return err
 	}
 
-	_, err = k.client.NetworkingV1().NetworkPolicies(objectMeta.Namespace).Create(ctx, networkPolicy, metav1.CreateOptions{})
-	if err != nil {
-		if !apierrors.IsAlreadyExists(err) {
-			return err
+	networkPolicies := k.client.NetworkingV1().NetworkPolicies(objectMeta.Namespace)
+	action := "update"
+	existing, err := networkPolicies.Get(ctx, networkPolicy.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		action = "create"
+	} else if err != nil {
+		return err
+	} else {
+		// Policy names can be predicted, so a policy created by someone else is never taken over
+		if !isManaged(existing.Labels) {
+			return fmt.Errorf("network policy %v in namespace %v is not managed by knep", existing.Name, existing.Namespace)
 		}
-		_, err := k.client.NetworkingV1().NetworkPolicies(objectMeta.Namespace).Update(ctx, networkPolicy, metav1.UpdateOptions{})
-		if err != nil {
-			return err
+
+		// Applying is also what removes an owner reference to an earlier pod with the same name
+		if equality.Semantic.DeepEqual(existing.Spec, networkPolicy.Spec) && hasLabels(existing.Labels, networkPolicy.Labels) &&
+			equality.Semantic.DeepEqual(podOwnerReferences(existing.OwnerReferences), objectMeta.OwnerReferences) {
+			metrics.PolicyWrites.WithLabelValues("NetworkPolicy", "skip").Inc()
+			return nil
 		}
 	}
 
+	applyConfiguration, err := networkPolicyApplyConfiguration(networkPolicy)
+	if err != nil {
+		return err
+	}
+
+	err = k.applyWithConflictHandling("NetworkPolicy", objectMeta, func(force bool) error {
+		_, err := networkPolicies.Apply(ctx, applyConfiguration, metav1.ApplyOptions{FieldManager: fieldManager, Force: force})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	metrics.PolicyWrites.WithLabelValues("NetworkPolicy", action).Inc()
+
 	return nil
 }
 
-func (k *K8SClient) createOrUpdateFQDNNetworkPolicyWithRetry(ctx context.Context, objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[int32][]string) error {
+func (k *K8SClient) createOrUpdateFQDNNetworkPolicyWithRetry(ctx context.Context, objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) error {
 	if len(portHostMap) == 0 {
 		return nil
 	}
 
-	fqdnNetworkPolicy, err := createFQDNNetworkPolicy(objectMeta, podSelector, portHostMap)
+	fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(objectMeta, podSelector, portHostMap)
 	if err != nil {
 		return err
 	}
 
 	var fqdnErr error
 	for i := 1; i <= numFQDNRetries; i++ {
+		if i > 1 {
+			metrics.FQDNNetpolRetries.Inc()
+		}
 		if fqdnErr = k.createOrUpdateFQDNNetworkPolicy(ctx, fqdnNetworkPolicy, objectMeta); fqdnErr == nil {
 			break
 		}
@@ -150,29 +333,90 @@ func (k *K8SClient) createOrUpdateFQDNNetworkPolicyWithRetry(ctx context.Context
 		return fqdnErr
 	}
 
+	if !k.config.PolicyBackend.CreatesNetworkPolicy() {
+		return nil
+	}
+
 	return k.ensureNetpolCreated(ctx, fqdnNetworkPolicy.GetNamespace(), fqdnNetworkPolicy.GetName())
 }
 
 func (k *K8SClient) createOrUpdateFQDNNetworkPolicy(ctx context.Context, fqdnNetworkPolicy *unstructured.Unstructured, objectMeta metav1.ObjectMeta) error {
-	existing, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace(objectMeta.Namespace).Get(ctx, fqdnNetworkPolicy.GetName(), metav1.GetOptions{})
-	if err == nil {
-		existing.Object["spec"] = fqdnNetworkPolicy.Object["spec"]
-		_, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace(objectMeta.Namespace).Update(ctx, existing, metav1.UpdateOptions{})
-		if err != nil {
-			return err
+	backend := k.config.PolicyBackend
+	fqdnNetworkPolicies := k.dynamicClient.Resource(backend.Resource()).Namespace(objectMeta.Namespace)
+	action := "update"
+	existing, err := fqdnNetworkPolicies.Get(ctx, fqdnNetworkPolicy.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		action = "create"
+	} else if err != nil {
+		return err
+	} else {
+		if !isManaged(existing.GetLabels()) {
+			return fmt.Errorf("%v %v in namespace %v is not managed by knep", backend.Kind(), existing.GetName(), existing.GetNamespace())
 		}
-	} else if apierrors.IsNotFound(err) {
-		_, err = k.dynamicClient.Resource(fqdnNetpolResource).Namespace(objectMeta.Namespace).Create(ctx, fqdnNetworkPolicy, metav1.CreateOptions{})
-		if err != nil {
-			return err
+
+		if equality.Semantic.DeepEqual(existing.Object["spec"], fqdnNetworkPolicy.Object["spec"]) && hasLabels(existing.GetLabels(), objectMeta.Labels) &&
+			equality.Semantic.DeepEqual(podOwnerReferences(existing.GetOwnerReferences()), objectMeta.OwnerReferences) {
+			metrics.PolicyWrites.WithLabelValues(backend.Kind(), "skip").Inc()
+			return nil
 		}
-	} else {
+	}
+
+	err = k.applyWithConflictHandling(backend.Kind(), objectMeta, func(force bool) error {
+		_, err := fqdnNetworkPolicies.Apply(ctx, fqdnNetworkPolicy.GetName(), fqdnNetworkPolicy, metav1.ApplyOptions{FieldManager: fieldManager, Force: force})
+		return err
+	})
+	if err != nil {
 		return err
 	}
+	metrics.PolicyWrites.WithLabelValues(backend.Kind(), action).Inc()
 
 	return nil
 }
 
+// applyWithConflictHandling applies a policy, forcing knep's values on a conflict.
+func (k *K8SClient) applyWithConflictHandling(kind string, objectMeta metav1.ObjectMeta, apply func(force bool) error) error {
+	err := apply(false)
+	if !apierrors.IsConflict(err) {
+		return err
+	}
+
+	k.logger.Warn("fields of policy changed by another field manager, overwriting them", "kind", kind, "namespace", objectMeta.Namespace, "name", objectMeta.Name, "error", err)
+	metrics.PolicyApplyConflicts.WithLabelValues(kind).Inc()
+
+	return apply(true)
+}
+
+// networkPolicyApplyConfiguration converts a network policy into an apply configuration.
+func networkPolicyApplyConfiguration(networkPolicy *networkingv1.NetworkPolicy) (*networkingv1apply.NetworkPolicyApplyConfiguration, error) {
+	networkPolicy = networkPolicy.DeepCopy()
+	networkPolicy.TypeMeta = metav1.TypeMeta{
+		APIVersion: networkingv1.SchemeGroupVersion.String(),
+		Kind:       "NetworkPolicy",
+	}
+
+	data, err := json.Marshal(networkPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	applyConfiguration := &networkingv1apply.NetworkPolicyApplyConfiguration{}
+	if err := json.Unmarshal(data, applyConfiguration); err != nil {
+		return nil, err
+	}
+
+	return applyConfiguration, nil
+}
+
+func hasLabels(labels, desired map[string]string) bool {
+	for key, value := range desired {
+		if labels[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (k *K8SClient) ensureNetpolCreated(ctx context.Context, namespace, name string) error {
 	timeout := int64(netpolCreatedTimeoutSeconds)
 	watcher, err := k.client.NetworkingV1().NetworkPolicies(namespace).Watch(ctx, metav1.ListOptions{
@@ -192,16 +436,73 @@ func (k *K8SClient) ensureNetpolCreated(ctx context.Context, namespace, name str
 	}
 
 	k.logger.Info("netpol for corresponding fqdn netpol not created", "namespace", namespace, "fqdn", name)
+	metrics.NetpolCreatedTimeouts.Inc()
 	return nil
 }
 
-func (k *K8SClient) deleteNetpol(ctx context.Context, pod corev1.Pod) error {
-	err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace(pod.Namespace).Delete(ctx, pod.Name+"-fqdn", metav1.DeleteOptions{})
+func (k *K8SClient) deleteNetpol(ctx context.Context, pod corev1.Pod, serverDryRun bool) ([]string, error) {
+	if serverDryRun {
+		return nil, nil
+	}
+
+	if k.isSharedPolicyPod(pod) {
+		return nil, k.deleteSharedNetpol(ctx, pod)
+	}
+
+	networkPolicyName, fqdnNetworkPolicyName := k.policyNames(pod)
+	if err := k.deleteManagedFQDNNetworkPolicy(ctx, pod.Namespace, fqdnNetworkPolicyName); err != nil {
+		return nil, err
+	}
+
+	if err := k.deleteManagedNetworkPolicy(ctx, pod.Namespace, networkPolicyName); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// deleteManagedNetworkPolicy deletes the network policy unless it is not managed by knep.
+// The delete is conditional on the policy read, so a policy replaced in the meantime is kept.
+func (k *K8SClient) deleteManagedNetworkPolicy(ctx context.Context, namespace, name string) error {
+	networkPolicies := k.client.NetworkingV1().NetworkPolicies(namespace)
+	networkPolicy, err := networkPolicies.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !isManaged(networkPolicy.Labels) {
+		k.logger.Warn("not deleting policy not managed by knep", "kind", "NetworkPolicy", "namespace", namespace, "name", name)
+		return nil
+	}
+
+	err = networkPolicies.Delete(ctx, name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &networkPolicy.UID, ResourceVersion: &networkPolicy.ResourceVersion}})
 	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
 
-	err = k.client.NetworkingV1().NetworkPolicies(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	return nil
+}
+
+// deleteManagedFQDNNetworkPolicy deletes the fqdn network policy unless it is not managed by knep.
+func (k *K8SClient) deleteManagedFQDNNetworkPolicy(ctx context.Context, namespace, name string) error {
+	backend := k.config.PolicyBackend
+	fqdnNetworkPolicies := k.dynamicClient.Resource(backend.Resource()).Namespace(namespace)
+	fqdnNetworkPolicy, err := fqdnNetworkPolicies.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !isManaged(fqdnNetworkPolicy.GetLabels()) {
+		k.logger.Warn("not deleting policy not managed by knep", "kind", backend.Kind(), "namespace", namespace, "name", name)
+		return nil
+	}
+
+	uid, resourceVersion := fqdnNetworkPolicy.GetUID(), fqdnNetworkPolicy.GetResourceVersion()
+	err = fqdnNetworkPolicies.Delete(ctx, name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &resourceVersion}})
 	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
@@ -209,32 +510,46 @@ func (k *K8SClient) deleteNetpol(ctx context.Context, pod corev1.Pod) error {
 	return nil
 }
 
-func (k *K8SClient) createNetworkPolicy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[int32][]string) (*networkingv1.NetworkPolicy, error) {
+func (k *K8SClient) createNetworkPolicy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[hostmap.Port][]string) (*networkingv1.NetworkPolicy, error) {
 	egressRules := []networkingv1.NetworkPolicyEgressRule{}
-	for port, hosts := range portHostMap {
-
+	for _, rule := range groupEgressRules(portHostMap) {
 		policyPeers := []networkingv1.NetworkPolicyPeer{}
-		for _, host := range hosts {
-			ip, cidr, err := parseIPHost(host)
+		for _, host := range rule.hosts {
+			// Invalid entries are handled by the invalid entry policy before this, so an
+			// IP host that can not be parsed here is an error rather than left out
+			cidr, err := ipBlockCIDR(host)
 			if err != nil {
-				k.logger.Error("parsing IP host", "error", err, "host", host)
-				continue
+				return nil, err
 			}
 			policyPeers = append(policyPeers, networkingv1.NetworkPolicyPeer{
 				IPBlock: &networkingv1.IPBlock{
-					CIDR: ip + "/" + cidr,
+					CIDR: cidr,
 				},
 			})
 		}
+		// A rule without peers would allow egress to every destination
+		if len(policyPeers) == 0 {
+			continue
+		}
+
+		policyPorts := []networkingv1.NetworkPolicyPort{}
+		for _, port := range rule.ports {
+			protocol := corev1.Protocol(port.Protocol)
+			policyPort := networkingv1.NetworkPolicyPort{
+				Protocol: &protocol,
+				Port:     &intstr.IntOrString{IntVal: port.Number},
+			}
+			if port.EndPort != 0 {
+				endPort := port.EndPort
+				policyPort.EndPort = &endPort
+			}
+			policyPorts = append(policyPorts, policyPort)
+		}
 
 		egressRules = append(egressRules,
 			networkingv1.NetworkPolicyEgressRule{
-				To: policyPeers,
-				Ports: []networkingv1.NetworkPolicyPort{
-					{
-						Port: &intstr.IntOrString{IntVal: port},
-					},
-				},
+				To:    policyPeers,
+				Ports: policyPorts,
 			})
 	}
 
@@ -250,90 +565,53 @@ func (k *K8SClient) createNetworkPolicy(objectMeta metav1.ObjectMeta, podSelecto
 	}, nil
 }
 
-func createFQDNNetworkPolicy(objectMeta metav1.ObjectMeta, podSelector metav1.LabelSelector, portHostMap map[int32][]string) (*unstructured.Unstructured, error) {
-	egressRules := []map[string]any{}
-	for port, hosts := range portHostMap {
-		egressRules = append(egressRules, map[string]any{
-			"to": []map[string][]string{
-				{
-					"fqdns": hosts,
-				},
-			},
-			"ports": []map[string]any{
-				{
-					"port": port,
-				},
-			},
-		})
+// policyNames returns the names of the network policy and the fqdn network policy
+// for the pod. The names recorded on the pod by the mutating webhook are never read,
+// as users can set the same annotations to point knep at any policy in the namespace.
+func (k *K8SClient) policyNames(pod corev1.Pod) (string, string) {
+	networkPolicyName := pod.Name
+	if profile, ok := k.sharedPolicyProfile(pod); ok && k.isSharedPolicyPod(pod) {
+		networkPolicyName = sharedPolicyName(profile, pod)
 	}
 
-	fqdnNetpol := &unstructured.Unstructured{}
-	fqdnNetpol.SetUnstructuredContent(map[string]interface{}{
-		"apiVersion": "networking.gke.io/v1alpha3",
-		"kind":       "FQDNNetworkPolicy",
-		"metadata": map[string]any{
-			"name":      objectMeta.Name + "-fqdn",
-			"namespace": objectMeta.Namespace,
-			"labels":    objectMeta.Labels,
-		},
-		"spec": map[string]any{
-			"podSelector": map[string]any{
-				"matchLabels": podSelector.MatchLabels,
-			},
-			"egress": egressRules,
-			"policyTypes": []string{
-				"Egress",
-			},
-		},
-	})
-
-	return fqdnNetpol, nil
+	return networkPolicyName, networkPolicyName + "-fqdn"
 }
 
-func isRelevantPod(podLabels map[string]string) bool {
-	// Check if Jupyter
-	if component, ok := podLabels[jupyterPodLabelKey]; ok && component == jupyterhubLabelValue {
-		return true
-	}
-
-	// Check if Airflow
-	if _, ok := podLabels[airflowPodLabelKey]; ok {
-		return true
-	}
+func (k *K8SClient) isRelevantPod(podLabels map[string]string) bool {
+	_, ok := k.config.Workloads.Match(podLabels)
+	return ok
+}
 
-	return false
+// serviceAndTeam returns the service and team of the pod for the allowlist statistics.
+func (k *K8SClient) serviceAndTeam(pod corev1.Pod) (string, string) {
+	profile, _ := k.config.Workloads.Match(pod.Labels)
+	return profile.ServiceAndTeam(pod)
 }
 
-func createPodSelector(pod corev1.Pod) (metav1.LabelSelector, error) {
-	if component, ok := pod.Labels[jupyterPodLabelKey]; ok && component == jupyterhubLabelValue {
-		return metav1.LabelSelector{
-			MatchLabels: map[string]string{
-				"component":                pod.Labels["component"],
-				"hub.jupyter.org/username": pod.Labels["hub.jupyter.org/username"],
-			},
-		}, nil
+func (k *K8SClient) createPodSelector(pod corev1.Pod) (metav1.LabelSelector, error) {
+	if profile, ok := k.sharedPolicyProfile(pod); ok && k.isSharedPolicyPod(pod) {
+		return sharedPodSelector(profile, pod), nil
 	}
 
-	if _, ok := pod.Labels[airflowPodLabelKey]; ok {
-		return metav1.LabelSelector{
-			MatchLabels: map[string]string{
-				"run_id":  pod.Labels["run_id"],
-				"dag_id":  pod.Labels["dag_id"],
-				"task_id": pod.Labels["task_id"],
-			},
-		}, nil
+	profile, ok := k.config.Workloads.Match(pod.Labels)
+	if !ok {
+		return metav1.LabelSelector{}, fmt.Errorf("invalid pod labels when creating network policy for pod %v", pod.Name)
 	}
 
-	return metav1.LabelSelector{}, fmt.Errorf("invalid pod labels when creating network policy for pod %v", pod.Name)
+	return profile.PodSelector(pod)
 }
 
-func parseIPHost(host string) (string, string, error) {
-	hostParts := strings.Split(host, "/")
-	if len(hostParts) == 1 {
-		return host, "32", nil
-	} else if len(hostParts) == 2 {
-		return hostParts[0], hostParts[1], nil
+// ipBlockCIDR returns the CIDR of an IPv4 or IPv6 address or CIDR, defaulting to
+// /32 for IPv4 and /128 for IPv6 addresses.
+func ipBlockCIDR(host string) (string, error) {
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		return prefix.Masked().String(), nil
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid ip host: %v", host)
 	}
 
-	return "", "", fmt.Errorf("invalid ip host: %v", host)
+	return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
 }
@@ -0,0 +1,318 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func Test_deleteNetpolIgnoresRecordedNames(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod",
+			Namespace: "team-a",
+			Annotations: map[string]string{
+				networkPolicyNameAnnotationKey:     "other",
+				fqdnNetworkPolicyNameAnnotationKey: "other-fqdn",
+			},
+		},
+	}
+
+	k := newTestK8SClient(t,
+		[]runtime.Object{testNetworkPolicy("pod", time.Now()), testNetworkPolicy("other", time.Now())},
+		testFQDNNetworkPolicy("pod-fqdn", time.Now()),
+		testFQDNNetworkPolicy("other-fqdn", time.Now()),
+	)
+
+	if _, err := k.deleteNetpol(context.Background(), pod, false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "pod", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected network policy to be deleted, got %v", err)
+	}
+
+	_, err = k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").Get(context.Background(), "pod-fqdn", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected fqdn network policy to be deleted, got %v", err)
+	}
+
+	// The annotations are set by users as well, so the policies they name are kept
+	if _, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "other", metav1.GetOptions{}); err != nil {
+		t.Errorf("network policy named by the pod annotation deleted, got %v", err)
+	}
+
+	if _, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").Get(context.Background(), "other-fqdn", metav1.GetOptions{}); err != nil {
+		t.Errorf("fqdn network policy named by the pod annotation deleted, got %v", err)
+	}
+}
+
+func Test_unmanagedPoliciesNotChanged(t *testing.T) {
+	unmanagedNetpol := testNetworkPolicy("pod", time.Now())
+	unmanagedNetpol.Labels = nil
+	unmanagedFQDNNetpol := testFQDNNetworkPolicy("pod-fqdn", time.Now())
+	unmanagedFQDNNetpol.SetLabels(nil)
+
+	k := newTestK8SClient(t, []runtime.Object{unmanagedNetpol}, unmanagedFQDNNetpol)
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{
+		Name:      "pod",
+		Namespace: "team-a",
+		Labels:    map[string]string{managedByLabelKey: managedByLabelValue},
+	}
+	fqdnObjectMeta := *objectMeta.DeepCopy()
+	fqdnObjectMeta.Name = "pod-fqdn"
+	podSelector := metav1.LabelSelector{MatchLabels: map[string]string{"dag_id": "dag"}}
+
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, map[hostmap.Port][]string{tcpPort(443): {"10.0.0.1"}}); err == nil {
+		t.Errorf("createOrUpdateNetworkPolicy() error = nil, want an error for a policy not managed by knep")
+	}
+
+	fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(fqdnObjectMeta, podSelector, map[hostmap.Port][]string{tcpPort(443): {"pypi.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.createOrUpdateFQDNNetworkPolicy(ctx, fqdnNetworkPolicy, fqdnObjectMeta); err == nil {
+		t.Errorf("createOrUpdateFQDNNetworkPolicy() error = nil, want an error for a policy not managed by knep")
+	}
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "team-a"}}
+	if _, err := k.deleteNetpol(ctx, pod, false); err != nil {
+		t.Fatal(err)
+	}
+
+	networkPolicy, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(ctx, "pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("network policy not managed by knep deleted, got %v", err)
+	}
+	if len(networkPolicy.Spec.Egress) != 0 {
+		t.Errorf("network policy not managed by knep changed, egress = %v", networkPolicy.Spec.Egress)
+	}
+
+	if _, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").Get(ctx, "pod-fqdn", metav1.GetOptions{}); err != nil {
+		t.Errorf("fqdn network policy not managed by knep deleted, got %v", err)
+	}
+}
+
+func Test_ipBlockCIDR(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "1.2.3.4", want: "1.2.3.4/32"},
+		{host: "151.101.0.0/16", want: "151.101.0.0/16"},
+		{host: "2001:db8::1", want: "2001:db8::1/128"},
+		{host: "2001:db8:1::/48", want: "2001:db8:1::/48"},
+		{host: "2001:db8:1::5/48", want: "2001:db8:1::/48"},
+		{host: "db.nav.no", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := ipBlockCIDR(tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ipBlockCIDR() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ipBlockCIDR() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_createNetworkPolicyInvalidIP(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	portHostMap := map[hostmap.Port][]string{
+		tcpPort(443): {"10.0.0.1", "10.0.0"},
+	}
+
+	if _, err := k.createNetworkPolicy(metav1.ObjectMeta{Name: "pod", Namespace: "team-a"}, metav1.LabelSelector{}, portHostMap); err == nil {
+		t.Errorf("createNetworkPolicy() error = nil, want an error for an invalid IP host")
+	}
+}
+
+func Test_policyProtocols(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	objectMeta := metav1.ObjectMeta{Name: "pod", Namespace: "team-a"}
+	portHostMap := map[hostmap.Port][]string{
+		{Number: 514, Protocol: hostmap.ProtocolUDP}: {"10.0.0.1"},
+	}
+
+	networkPolicy, err := k.createNetworkPolicy(objectMeta, metav1.LabelSelector{}, portHostMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := networkPolicy.Spec.Egress[0].Ports[0]
+	if port.Protocol == nil || *port.Protocol != corev1.ProtocolUDP || port.Port.IntVal != 514 {
+		t.Errorf("createNetworkPolicy() port = %v/%v, want 514/UDP", port.Port, port.Protocol)
+	}
+
+	fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(objectMeta, metav1.LabelSelector{}, portHostMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress, _, _ := unstructured.NestedSlice(fqdnNetworkPolicy.Object, "spec", "egress")
+	ports, _, _ := unstructured.NestedSlice(egress[0].(map[string]any), "ports")
+	fqdnPort := ports[0].(map[string]any)
+	if fqdnPort["protocol"] != "UDP" || fqdnPort["port"] != int64(514) {
+		t.Errorf("Policy() port = %v, want 514/UDP", fqdnPort)
+	}
+}
+
+func Test_policyPortRanges(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	objectMeta := metav1.ObjectMeta{Name: "pod", Namespace: "team-a"}
+	portHostMap := map[hostmap.Port][]string{
+		{Number: 6005, EndPort: 6010, Protocol: hostmap.ProtocolTCP}: {"10.0.0.1"},
+	}
+
+	networkPolicy, err := k.createNetworkPolicy(objectMeta, metav1.LabelSelector{}, portHostMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networkPolicy.Spec.Egress) != 1 || len(networkPolicy.Spec.Egress[0].Ports) != 1 {
+		t.Fatalf("createNetworkPolicy() egress = %v, want a single rule with a single port", networkPolicy.Spec.Egress)
+	}
+	port := networkPolicy.Spec.Egress[0].Ports[0]
+	if port.Port.IntVal != 6005 || port.EndPort == nil || *port.EndPort != 6010 {
+		t.Errorf("createNetworkPolicy() port = %v-%v, want 6005-6010", port.Port, port.EndPort)
+	}
+
+	fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(objectMeta, metav1.LabelSelector{}, portHostMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress, _, _ := unstructured.NestedSlice(fqdnNetworkPolicy.Object, "spec", "egress")
+	if len(egress) != 1 {
+		t.Fatalf("Policy() egress = %v, want a single rule", egress)
+	}
+	if ports, _, _ := unstructured.NestedSlice(egress[0].(map[string]any), "ports"); len(ports) != 6 {
+		t.Errorf("Policy() ports = %v, want 6 ports", ports)
+	}
+}
+
+func Test_createOrUpdateSkipsNoopUpdates(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{
+		Name:      "pod",
+		Namespace: "team-a",
+		Labels:    map[string]string{managedByLabelKey: managedByLabelValue},
+	}
+	podSelector := metav1.LabelSelector{MatchLabels: map[string]string{"dag_id": "dag"}}
+	portHostMap := map[hostmap.Port][]string{
+		tcpPort(443):  {"10.0.0.1", "10.0.0.2"},
+		tcpPort(1521): {"10.0.1.1"},
+	}
+
+	netpolWrites := func(action string) float64 {
+		return testutil.ToFloat64(metrics.PolicyWrites.WithLabelValues("NetworkPolicy", action))
+	}
+	fqdnWrites := func(action string) float64 {
+		return testutil.ToFloat64(metrics.PolicyWrites.WithLabelValues("FQDNNetworkPolicy", action))
+	}
+	createsBefore, updatesBefore, skipsBefore := netpolWrites("create"), netpolWrites("update"), netpolWrites("skip")
+	fqdnCreatesBefore, fqdnUpdatesBefore, fqdnSkipsBefore := fqdnWrites("create"), fqdnWrites("update"), fqdnWrites("skip")
+
+	for range 2 {
+		if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, portHostMap); err != nil {
+			t.Fatal(err)
+		}
+
+		fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(objectMeta, podSelector, portHostMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := k.createOrUpdateFQDNNetworkPolicy(ctx, fqdnNetworkPolicy, objectMeta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := netpolWrites("create") - createsBefore; got != 1 {
+		t.Errorf("NetworkPolicy creates = %v, want 1", got)
+	}
+	if got := netpolWrites("skip") - skipsBefore; got != 1 {
+		t.Errorf("NetworkPolicy skips = %v, want 1", got)
+	}
+	if got := fqdnWrites("create") - fqdnCreatesBefore; got != 1 {
+		t.Errorf("FQDNNetworkPolicy creates = %v, want 1", got)
+	}
+	if got := fqdnWrites("skip") - fqdnSkipsBefore; got != 1 {
+		t.Errorf("FQDNNetworkPolicy skips = %v, want 1", got)
+	}
+
+	portHostMap[tcpPort(5432)] = []string{"10.0.2.1"}
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, portHostMap); err != nil {
+		t.Fatal(err)
+	}
+	fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(objectMeta, podSelector, portHostMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.createOrUpdateFQDNNetworkPolicy(ctx, fqdnNetworkPolicy, objectMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := netpolWrites("update") - updatesBefore; got != 1 {
+		t.Errorf("NetworkPolicy updates = %v, want 1", got)
+	}
+	if got := fqdnWrites("update") - fqdnUpdatesBefore; got != 1 {
+		t.Errorf("FQDNNetworkPolicy updates = %v, want 1", got)
+	}
+}
+
+func Test_createOrUpdateKeepsFieldsFromOtherManagers(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{
+		Name:      "pod",
+		Namespace: "team-a",
+		Labels:    map[string]string{managedByLabelKey: managedByLabelValue},
+	}
+	podSelector := metav1.LabelSelector{MatchLabels: map[string]string{"dag_id": "dag"}}
+	portHostMap := map[hostmap.Port][]string{
+		tcpPort(443): {"10.0.0.1"},
+	}
+
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, portHostMap); err != nil {
+		t.Fatal(err)
+	}
+
+	networkPolicies := k.client.NetworkingV1().NetworkPolicies(objectMeta.Namespace)
+	networkPolicy, err := networkPolicies.Get(ctx, objectMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkPolicy.Labels["team"] = "team-a"
+	networkPolicy.Annotations = map[string]string{"owner": "admin"}
+	if _, err := networkPolicies.Update(ctx, networkPolicy, metav1.UpdateOptions{FieldManager: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	portHostMap[tcpPort(5432)] = []string{"10.0.1.1"}
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, portHostMap); err != nil {
+		t.Fatal(err)
+	}
+
+	networkPolicy, err = networkPolicies.Get(ctx, objectMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if networkPolicy.Labels["team"] != "team-a" || networkPolicy.Annotations["owner"] != "admin" {
+		t.Errorf("createOrUpdateNetworkPolicy() labels = %v, annotations = %v, want fields from admin kept", networkPolicy.Labels, networkPolicy.Annotations)
+	}
+	if len(networkPolicy.Spec.Egress) != 2 {
+		t.Errorf("createOrUpdateNetworkPolicy() egress = %v, want 2 rules", networkPolicy.Spec.Egress)
+	}
+}
@@ -0,0 +1,224 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const ownerReferencerResync = 10 * time.Minute
+
+// policyListers read the knep managed policies from the cache of the owner referencer.
+type policyListers struct {
+	networkPolicies     networkinglisters.NetworkPolicyLister
+	fqdnNetworkPolicies cache.GenericLister
+}
+
+// RunOwnerReferencer adds an owner reference from stored pods to their knep managed
+// policies, so that Kubernetes garbage collects them with the pod.
+func (k *K8SClient) RunOwnerReferencer(ctx context.Context) {
+	managed := func(options *metav1.ListOptions) {
+		options.LabelSelector = labels.SelectorFromSet(labels.Set{managedByLabelKey: managedByLabelValue}).String()
+	}
+	policyInformers := informers.NewSharedInformerFactoryWithOptions(k.client, ownerReferencerResync, informers.WithTweakListOptions(managed), informers.WithTransform(stripManagedFields))
+	fqdnPolicyInformers := dynamicinformer.NewFilteredDynamicSharedInformerFactory(k.dynamicClient, ownerReferencerResync, metav1.NamespaceAll, managed)
+	fqdnPolicyInformer := fqdnPolicyInformers.ForResource(k.config.PolicyBackend.Resource())
+	if err := fqdnPolicyInformer.Informer().SetTransform(stripManagedFields); err != nil {
+		k.logger.Error("setting policy informer transform", "error", err)
+		return
+	}
+	// Only the pod metadata is watched
+	podInformers := metadatainformer.NewSharedInformerFactoryWithOptions(k.metadataClient, ownerReferencerResync, metadatainformer.WithTransform(stripPod))
+	podInformer := podInformers.ForResource(corev1.SchemeGroupVersion.WithResource("pods")).Informer()
+
+	listers := policyListers{
+		networkPolicies:     policyInformers.Networking().V1().NetworkPolicies().Lister(),
+		fqdnNetworkPolicies: fqdnPolicyInformer.Lister(),
+	}
+	_, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			k.handlePodEvent(ctx, listers, obj)
+		},
+		UpdateFunc: func(_, obj any) {
+			k.handlePodEvent(ctx, listers, obj)
+		},
+	})
+	if err != nil {
+		k.logger.Error("adding pod event handler", "error", err)
+		return
+	}
+
+	// Pod events are only handled once the policies are cached
+	policyInformers.Start(ctx.Done())
+	fqdnPolicyInformers.Start(ctx.Done())
+	policyInformers.WaitForCacheSync(ctx.Done())
+	fqdnPolicyInformers.WaitForCacheSync(ctx.Done())
+	podInformers.Start(ctx.Done())
+
+	<-ctx.Done()
+	podInformers.Shutdown()
+	policyInformers.Shutdown()
+	fqdnPolicyInformers.Shutdown()
+}
+
+// stripPod keeps only the pod metadata knep reads in the informer cache
+func stripPod(obj any) (any, error) {
+	pod, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok {
+		return obj, nil
+	}
+
+	return &metav1.PartialObjectMetadata{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              pod.Name,
+			Namespace:         pod.Namespace,
+			UID:               pod.UID,
+			ResourceVersion:   pod.ResourceVersion,
+			DeletionTimestamp: pod.DeletionTimestamp,
+			Labels:            pod.Labels,
+			Annotations:       pod.Annotations,
+		},
+	}, nil
+}
+
+func stripManagedFields(obj any) (any, error) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetManagedFields(nil)
+	}
+
+	return obj, nil
+}
+
+func (k *K8SClient) handlePodEvent(ctx context.Context, listers policyListers, obj any) {
+	podMetadata, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok || podMetadata.DeletionTimestamp != nil || podMetadata.UID == "" {
+		return
+	}
+	pod := corev1.Pod{ObjectMeta: podMetadata.ObjectMeta}
+
+	// Shared policies are reference counted by knep instead of owned by a single pod
+	if !k.isRelevantPod(pod.Labels) || k.isSharedPolicyPod(pod) {
+		return
+	}
+
+	hasAllowlist, err := k.hasAllowlist(ctx, pod)
+	if err != nil {
+		k.logger.Error("reading allowlist of pod", "error", err, "namespace", pod.Namespace, "pod", pod.Name)
+		return
+	}
+	if !hasAllowlist {
+		return
+	}
+
+	if err := k.addOwnerReferences(ctx, listers, pod); err != nil {
+		k.logger.Error("adding owner references to policies", "error", err, "namespace", pod.Namespace, "pod", pod.Name)
+	}
+}
+
+// addOwnerReferences applies the cached policies of the pod again with an owner reference to it.
+func (k *K8SClient) addOwnerReferences(ctx context.Context, listers policyListers, pod corev1.Pod) error {
+	ownerReferences := []metav1.OwnerReference{podOwnerReference(pod)}
+	networkPolicyName, fqdnNetworkPolicyName := k.policyNames(pod)
+
+	networkPolicy, err := listers.networkPolicies.NetworkPolicies(pod.Namespace).Get(networkPolicyName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && !equality.Semantic.DeepEqual(podOwnerReferences(networkPolicy.OwnerReferences), ownerReferences) {
+		objectMeta := managedObjectMeta(networkPolicyName, pod.Namespace)
+		objectMeta.OwnerReferences = ownerReferences
+		applyConfiguration, err := networkPolicyApplyConfiguration(&networkingv1.NetworkPolicy{ObjectMeta: objectMeta, Spec: networkPolicy.Spec})
+		if err != nil {
+			return err
+		}
+
+		networkPolicies := k.client.NetworkingV1().NetworkPolicies(pod.Namespace)
+		err = k.applyWithConflictHandling("NetworkPolicy", objectMeta, func(force bool) error {
+			_, err := networkPolicies.Apply(ctx, applyConfiguration, metav1.ApplyOptions{FieldManager: fieldManager, Force: force})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	backend := k.config.PolicyBackend
+	obj, err := listers.fqdnNetworkPolicies.ByNamespace(pod.Namespace).Get(fqdnNetworkPolicyName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if fqdnNetworkPolicy, ok := obj.(*unstructured.Unstructured); err == nil && ok && !equality.Semantic.DeepEqual(podOwnerReferences(fqdnNetworkPolicy.GetOwnerReferences()), ownerReferences) {
+		spec, _, err := unstructured.NestedMap(fqdnNetworkPolicy.Object, "spec")
+		if err != nil {
+			return err
+		}
+
+		objectMeta := managedObjectMeta(fqdnNetworkPolicyName, pod.Namespace)
+		objectMeta.OwnerReferences = ownerReferences
+		policy, err := newUnstructuredPolicy(backend.Resource(), backend.Kind(), objectMeta, spec)
+		if err != nil {
+			return err
+		}
+
+		fqdnNetworkPolicies := k.dynamicClient.Resource(backend.Resource()).Namespace(pod.Namespace)
+		err = k.applyWithConflictHandling(backend.Kind(), objectMeta, func(force bool) error {
+			_, err := fqdnNetworkPolicies.Apply(ctx, fqdnNetworkPolicyName, policy, metav1.ApplyOptions{FieldManager: fieldManager, Force: force})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// managedObjectMeta returns the metadata knep applies to the policies it manages.
+func managedObjectMeta(name, namespace string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels: map[string]string{
+			managedByLabelKey: managedByLabelValue,
+		},
+	}
+}
+
+func podOwnerReference(pod corev1.Pod) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}
+}
+
+// podOwnerReferences returns the owner references to pods.
+func podOwnerReferences(ownerReferences []metav1.OwnerReference) []metav1.OwnerReference {
+	var pods []metav1.OwnerReference
+	for _, ownerReference := range ownerReferences {
+		if ownerReference.APIVersion == "v1" && ownerReference.Kind == "Pod" {
+			pods = append(pods, ownerReference)
+		}
+	}
+
+	return pods
+}
+
+func isManaged(labels map[string]string) bool {
+	return labels[managedByLabelKey] == managedByLabelValue
+}
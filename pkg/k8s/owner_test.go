@@ -0,0 +1,266 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/hostmap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// testPolicyListers returns listers caching the policies as they are when called.
+func testPolicyListers(t *testing.T, k *K8SClient) policyListers {
+	t.Helper()
+
+	ctx := context.Background()
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+
+	networkPolicies, err := k.client.NetworkingV1().NetworkPolicies(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkPolicyIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+	for i := range networkPolicies.Items {
+		if err := networkPolicyIndexer.Add(&networkPolicies.Items[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resource := k.config.PolicyBackend.Resource()
+	fqdnNetworkPolicies, err := k.dynamicClient.Resource(resource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fqdnNetworkPolicyIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+	for i := range fqdnNetworkPolicies.Items {
+		if err := fqdnNetworkPolicyIndexer.Add(&fqdnNetworkPolicies.Items[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return policyListers{
+		networkPolicies:     networkinglisters.NewNetworkPolicyLister(networkPolicyIndexer),
+		fqdnNetworkPolicies: cache.NewGenericLister(fqdnNetworkPolicyIndexer, resource.GroupResource()),
+	}
+}
+
+func Test_addOwnerReferences(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	ctx := context.Background()
+	objectMeta := managedObjectMeta("running", "team-a")
+	fqdnObjectMeta := managedObjectMeta("running-fqdn", "team-a")
+	podSelector := metav1.LabelSelector{MatchLabels: map[string]string{"dag_id": "dag"}}
+
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, map[hostmap.Port][]string{tcpPort(1521): {"10.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	fqdnNetworkPolicy, err := k.config.PolicyBackend.Policy(fqdnObjectMeta, podSelector, map[hostmap.Port][]string{tcpPort(443): {"pypi.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.createOrUpdateFQDNNetworkPolicy(ctx, fqdnNetworkPolicy, fqdnObjectMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	// The policies were owned by an earlier pod with the same name, whose owner reference
+	// must be replaced
+	for _, uid := range []string{"old-uid", "new-uid"} {
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "team-a", UID: types.UID(uid)}}
+		if err := k.addOwnerReferences(ctx, testPolicyListers(t, k), pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []metav1.OwnerReference{
+		{APIVersion: "v1", Kind: "Pod", Name: "running", UID: "new-uid"},
+	}
+
+	networkPolicy, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(ctx, "running", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, networkPolicy.OwnerReferences); diff != "" {
+		t.Errorf("network policy owner references mismatch (-want +got):\n%s", diff)
+	}
+	if len(networkPolicy.Spec.Egress) != 1 || !isManaged(networkPolicy.Labels) {
+		t.Errorf("network policy spec = %v, labels = %v, want them kept", networkPolicy.Spec, networkPolicy.Labels)
+	}
+	for _, managedFields := range networkPolicy.ManagedFields {
+		if managedFields.Manager != fieldManager || managedFields.Operation != metav1.ManagedFieldsOperationApply {
+			t.Errorf("network policy fields managed by %v with %v, want only applied by %v", managedFields.Manager, managedFields.Operation, fieldManager)
+		}
+	}
+
+	fqdnNetworkPolicy, err = k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").Get(ctx, "running-fqdn", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, fqdnNetworkPolicy.GetOwnerReferences()); diff != "" {
+		t.Errorf("fqdn network policy owner references mismatch (-want +got):\n%s", diff)
+	}
+	if egress, _, _ := unstructured.NestedSlice(fqdnNetworkPolicy.Object, "spec", "egress"); len(egress) != 1 {
+		t.Errorf("fqdn network policy egress = %v, want it kept", egress)
+	}
+
+	for _, action := range append(k.client.(*fake.Clientset).Actions(), k.dynamicClient.(*dynamicfake.FakeDynamicClient).Actions()...) {
+		if action.GetVerb() == "update" {
+			t.Errorf("policy updated with %v, want policies only applied", action)
+		}
+	}
+}
+
+func Test_applyRemovesStaleOwnerReferences(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	ctx := context.Background()
+	podSelector := metav1.LabelSelector{MatchLabels: map[string]string{"dag_id": "dag"}}
+	portHostMap := map[hostmap.Port][]string{tcpPort(1521): {"10.0.0.1"}}
+	ownerReferences := func() []metav1.OwnerReference {
+		t.Helper()
+
+		networkPolicy, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(ctx, "running", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return networkPolicy.OwnerReferences
+	}
+
+	objectMeta := managedObjectMeta("running", "team-a")
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, portHostMap); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.addOwnerReferences(ctx, testPolicyListers(t, k), corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "team-a", UID: "old-uid"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new pod with the same name is not stored when admitted, so its policies are applied
+	// without an owner reference, removing the one to the earlier pod
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, portHostMap); err != nil {
+		t.Fatal(err)
+	}
+	if got := ownerReferences(); len(got) != 0 {
+		t.Errorf("owner references = %v, want the stale one removed", got)
+	}
+
+	// Once the pod is stored, applying the policy again keeps its owner reference
+	objectMeta.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: "running", UID: "new-uid"}}
+	if err := k.createOrUpdateNetworkPolicy(ctx, objectMeta, podSelector, portHostMap); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(objectMeta.OwnerReferences, ownerReferences()); diff != "" {
+		t.Errorf("owner references mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_handlePodEvent(t *testing.T) {
+	podMetadata := func(annotations map[string]string) *metav1.PartialObjectMetadata {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+			Name:        "running",
+			Namespace:   "team-a",
+			UID:         "uid",
+			Labels:      map[string]string{"dag_id": "dag"},
+			Annotations: annotations,
+		}}
+	}
+	owned := testNetworkPolicy("running", time.Now())
+	owned.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: "running", UID: "uid"}}
+
+	tests := []struct {
+		name      string
+		pod       *metav1.PartialObjectMetadata
+		existing  []runtime.Object
+		wantApply bool
+	}{
+		{
+			name:      "pod with allowlist",
+			pod:       podMetadata(map[string]string{allowListAnnotationKey: "10.0.0.1"}),
+			existing:  []runtime.Object{testNetworkPolicy("running", time.Now())},
+			wantApply: true,
+		},
+		{
+			name:     "pod without allowlist",
+			pod:      podMetadata(nil),
+			existing: []runtime.Object{testNetworkPolicy("running", time.Now())},
+		},
+		{
+			name:     "policies already owned by the pod",
+			pod:      podMetadata(map[string]string{allowListAnnotationKey: "10.0.0.1"}),
+			existing: []runtime.Object{owned},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newTestK8SClient(t, append(tt.existing, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}))
+			listers := testPolicyListers(t, k)
+			client := k.client.(*fake.Clientset)
+			client.ClearActions()
+
+			k.handlePodEvent(context.Background(), listers, tt.pod)
+
+			// The policies are read from the cache, so only applies reach the API server
+			applied := false
+			for _, action := range client.Actions() {
+				if action.GetVerb() != "patch" {
+					t.Errorf("handlePodEvent() made a %v request, want only applies", action.GetVerb())
+				}
+				applied = true
+			}
+			if applied != tt.wantApply {
+				t.Errorf("handlePodEvent() applied = %v, want %v", applied, tt.wantApply)
+			}
+		})
+	}
+}
+
+func Test_RunOwnerReferencer(t *testing.T) {
+	pod := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "running",
+			Namespace:   "team-a",
+			UID:         "uid",
+			Labels:      map[string]string{"dag_id": "dag"},
+			Annotations: map[string]string{allowListAnnotationKey: "10.0.0.1"},
+		},
+	}
+	k := newTestK8SClient(t, []runtime.Object{testNetworkPolicy("running", time.Now()), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}})
+	scheme := metadatafake.NewTestScheme()
+	if err := metav1.AddMetaToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k.metadataClient = metadatafake.NewSimpleMetadataClient(scheme, pod)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		k.RunOwnerReferencer(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		networkPolicy, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(ctx, "running", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return len(networkPolicy.OwnerReferences) == 1, nil
+	})
+	if err != nil {
+		t.Errorf("waiting for the owner reference to the pod: %v", err)
+	}
+}
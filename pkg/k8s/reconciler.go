@@ -0,0 +1,172 @@
+package k8s
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/navikt/knep/pkg/metrics"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	teamNamespaceLabelKey = "team-namespace"
+	// Policies are created in the admission call before the pod itself is persisted,
+	// so policies younger than this are never considered orphaned.
+	orphanGracePeriod = 5 * time.Minute
+)
+
+// RunReconciler periodically deletes knep managed policies whose pod no longer exists.
+// This cleans up after pods whose DELETE admission request never reached knep.
+func (k *K8SClient) RunReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := k.reconcile(ctx); err != nil {
+			k.logger.Error("reconciling orphaned policies", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *K8SClient) reconcile(ctx context.Context) error {
+	namespaces, err := k.client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: teamNamespaceLabelKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces.Items {
+		if err := k.reconcileNamespace(ctx, namespace.Name); err != nil {
+			k.logger.Error("reconciling orphaned policies in namespace", "error", err, "namespace", namespace.Name)
+		}
+	}
+
+	return nil
+}
+
+func (k *K8SClient) reconcileNamespace(ctx context.Context, namespace string) error {
+	managedSelector := labels.SelectorFromSet(labels.Set{managedByLabelKey: managedByLabelValue}).String()
+
+	pods, err := k.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	podNames := map[string]bool{}
+	for _, pod := range pods.Items {
+		podNames[pod.Name] = true
+	}
+
+	networkPolicies, err := k.client.NetworkingV1().NetworkPolicies(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedSelector,
+	})
+	if err != nil {
+		return err
+	}
+	for _, networkPolicy := range networkPolicies.Items {
+		if !isOrphaned(&networkPolicy, networkPolicy.Name, podNames) {
+			continue
+		}
+		if exists, err := k.anyPodExists(ctx, namespace, policyPodNames(&networkPolicy, networkPolicy.Name)); err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+
+		err := k.client.NetworkingV1().NetworkPolicies(namespace).Delete(ctx, networkPolicy.Name, orphanDeleteOptions(&networkPolicy))
+		if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		k.logOrphanDeleted("NetworkPolicy", namespace, networkPolicy.Name)
+	}
+
+	fqdnNetworkPolicies, err := k.dynamicClient.Resource(k.config.PolicyBackend.Resource()).Namespace(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedSelector,
+	})
+	if err != nil {
+		return err
+	}
+	for _, fqdnNetworkPolicy := range fqdnNetworkPolicies.Items {
+		podName := strings.TrimSuffix(fqdnNetworkPolicy.GetName(), "-fqdn")
+		if !isOrphaned(&fqdnNetworkPolicy, podName, podNames) {
+			continue
+		}
+		if exists, err := k.anyPodExists(ctx, namespace, policyPodNames(&fqdnNetworkPolicy, podName)); err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+
+		err := k.dynamicClient.Resource(k.config.PolicyBackend.Resource()).Namespace(namespace).Delete(ctx, fqdnNetworkPolicy.GetName(), orphanDeleteOptions(&fqdnNetworkPolicy))
+		if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		k.logOrphanDeleted(k.config.PolicyBackend.Kind(), namespace, fqdnNetworkPolicy.GetName())
+	}
+
+	return nil
+}
+
+func isOrphaned(policy metav1.Object, podName string, podNames map[string]bool) bool {
+	// Policies controlled by another object, such as the network policies the
+	// FQDN controller creates, are garbage collected together with their owner
+	if metav1.GetControllerOf(policy) != nil {
+		return false
+	}
+
+	if time.Since(policy.GetCreationTimestamp().Time) < orphanGracePeriod {
+		return false
+	}
+
+	return !slices.ContainsFunc(policyPodNames(policy, podName), func(name string) bool {
+		return podNames[name]
+	})
+}
+
+// policyPodNames returns the pods using the policy, the referenced pods for shared policies.
+func policyPodNames(policy metav1.Object, podName string) []string {
+	if references := podReferences(policy); len(references) > 0 {
+		return references
+	}
+
+	return []string{podName}
+}
+
+// anyPodExists reads the pods again, as they can be created after they were listed.
+func (k *K8SClient) anyPodExists(ctx context.Context, namespace string, names []string) (bool, error) {
+	for _, name := range names {
+		_, err := k.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			return true, nil
+		} else if !apierrors.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// orphanDeleteOptions makes the delete conditional on the listed policy.
+func orphanDeleteOptions(policy metav1.Object) metav1.DeleteOptions {
+	uid, resourceVersion := policy.GetUID(), policy.GetResourceVersion()
+	return metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &resourceVersion}}
+}
+
+func (k *K8SClient) logOrphanDeleted(kind, namespace, name string) {
+	k.logger.Info("deleted orphaned policy", "kind", kind, "namespace", namespace, "name", name)
+	metrics.OrphanedPoliciesDeleted.WithLabelValues(kind).Inc()
+}
@@ -0,0 +1,238 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestK8SClient(t *testing.T, objects []runtime.Object, dynamicObjects ...runtime.Object) *K8SClient {
+	t.Helper()
+	return newTestK8SClientWithConfig(t, Config{}, objects, dynamicObjects...)
+}
+
+func newTestK8SClientWithConfig(t *testing.T, cfg Config, objects []runtime.Object, dynamicObjects ...runtime.Object) *K8SClient {
+	t.Helper()
+
+	client := fake.NewClientset(objects...)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		fqdnNetpolResource:    "FQDNNetworkPolicyList",
+		gkeFQDNNetpolResource: "FQDNNetworkPolicyList",
+		ciliumNetpolResource:  "CiliumNetworkPolicyList",
+		calicoNetpolResource:  "NetworkPolicyList",
+		allowlistResource:     "AllowlistList",
+	}, dynamicObjects...)
+	// The object tracker of the fake dynamic client can not apply to unstructured objects,
+	// so applies are approximated with a merge patch
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(k8stesting.PatchAction)
+		if patchAction.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+
+		tracker := dynamicClient.Tracker()
+		gvr, namespace := patchAction.GetResource(), patchAction.GetNamespace()
+		existing, err := tracker.Get(gvr, namespace, patchAction.GetName())
+		if err != nil && !apierrors.IsNotFound(err) {
+			return true, nil, err
+		}
+
+		original := []byte("{}")
+		if err == nil {
+			if original, err = json.Marshal(existing); err != nil {
+				return true, nil, err
+			}
+		}
+
+		patched, err := jsonpatch.MergePatch(original, patchAction.GetPatch())
+		if err != nil {
+			return true, nil, err
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patched); err != nil {
+			return true, nil, err
+		}
+
+		if existing == nil {
+			return true, obj, tracker.Create(gvr, obj, namespace)
+		}
+		return true, obj, tracker.Update(gvr, obj, namespace)
+	})
+
+	k := NewWithClients(client, dynamicClient, metadatafake.NewSimpleMetadataClient(metadatafake.NewTestScheme()), cfg, nil, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err := k.StartNamespaceInformer(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func testNetworkPolicy(name string, created time.Time) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "team-a",
+			CreationTimestamp: metav1.NewTime(created),
+			Labels: map[string]string{
+				managedByLabelKey: managedByLabelValue,
+			},
+		},
+	}
+}
+
+func testFQDNNetworkPolicy(name string, created time.Time) *unstructured.Unstructured {
+	fqdnNetpol := &unstructured.Unstructured{}
+	fqdnNetpol.SetAPIVersion("networking.gke.io/v1alpha3")
+	fqdnNetpol.SetKind("FQDNNetworkPolicy")
+	fqdnNetpol.SetName(name)
+	fqdnNetpol.SetNamespace("team-a")
+	fqdnNetpol.SetCreationTimestamp(metav1.NewTime(created))
+	fqdnNetpol.SetLabels(map[string]string{
+		managedByLabelKey: managedByLabelValue,
+	})
+	return fqdnNetpol
+}
+
+func Test_reconcile(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+
+	controlledNetpol := testNetworkPolicy("orphan-fqdn", old)
+	isController := true
+	controlledNetpol.OwnerReferences = []metav1.OwnerReference{
+		{
+			APIVersion: "networking.gke.io/v1alpha3",
+			Kind:       "FQDNNetworkPolicy",
+			Name:       "orphan-fqdn",
+			Controller: &isController,
+		},
+	}
+
+	unmanagedNetpol := testNetworkPolicy("unmanaged", old)
+	unmanagedNetpol.Labels = nil
+
+	sharedNetpol := testNetworkPolicy("shared", old)
+	sharedNetpol.Annotations = map[string]string{podReferencesAnnotationKey: "finished,running"}
+	orphanSharedNetpol := testNetworkPolicy("orphan-shared", old)
+	orphanSharedNetpol.Annotations = map[string]string{podReferencesAnnotationKey: "finished"}
+
+	k := newTestK8SClient(t,
+		[]runtime.Object{
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{teamNamespaceLabelKey: "true"}}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "team-a"}},
+			testNetworkPolicy("running", old),
+			testNetworkPolicy("orphan", old),
+			testNetworkPolicy("starting", time.Now()),
+			controlledNetpol,
+			unmanagedNetpol,
+			sharedNetpol,
+			orphanSharedNetpol,
+		},
+		testFQDNNetworkPolicy("running-fqdn", old),
+		testFQDNNetworkPolicy("orphan-fqdn", old),
+		testFQDNNetworkPolicy("starting-fqdn", time.Now()),
+	)
+
+	deletedBefore := testutil.ToFloat64(metrics.OrphanedPoliciesDeleted.WithLabelValues("NetworkPolicy"))
+
+	if err := k.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	networkPolicies, err := k.client.NetworkingV1().NetworkPolicies("team-a").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotNetpols := []string{}
+	for _, networkPolicy := range networkPolicies.Items {
+		gotNetpols = append(gotNetpols, networkPolicy.Name)
+	}
+	if diff := cmp.Diff([]string{"orphan-fqdn", "running", "shared", "starting", "unmanaged"}, gotNetpols); diff != "" {
+		t.Errorf("reconcile() network policies mismatch (-want +got):\n%s", diff)
+	}
+
+	fqdnNetworkPolicies, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotFQDNNetpols := []string{}
+	for _, fqdnNetworkPolicy := range fqdnNetworkPolicies.Items {
+		gotFQDNNetpols = append(gotFQDNNetpols, fqdnNetworkPolicy.GetName())
+	}
+	if diff := cmp.Diff([]string{"running-fqdn", "starting-fqdn"}, gotFQDNNetpols); diff != "" {
+		t.Errorf("reconcile() fqdn network policies mismatch (-want +got):\n%s", diff)
+	}
+
+	if deleted := testutil.ToFloat64(metrics.OrphanedPoliciesDeleted.WithLabelValues("NetworkPolicy")) - deletedBefore; deleted != 2 {
+		t.Errorf("reconcile() deleted network policies metric = %v, want 2", deleted)
+	}
+}
+
+func Test_reconcileKeepsPoliciesOfPodsCreatedAfterListing(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+
+	k := newTestK8SClient(t,
+		[]runtime.Object{
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{teamNamespaceLabelKey: "true"}}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "recreated", Namespace: "team-a"}},
+			testNetworkPolicy("recreated", old),
+			testNetworkPolicy("orphan", old),
+		},
+		testFQDNNetworkPolicy("recreated-fqdn", old),
+	)
+	// The pod is admitted after the pods are listed, and its policies are left unchanged
+	// as their spec is the same
+	client := k.client.(*fake.Clientset)
+	client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, &corev1.PodList{}, nil
+	})
+
+	if err := k.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.client.NetworkingV1().NetworkPolicies("team-a").Get(context.Background(), "recreated", metav1.GetOptions{}); err != nil {
+		t.Errorf("network policy of the pod created after listing deleted, got %v", err)
+	}
+	if _, err := k.dynamicClient.Resource(fqdnNetpolResource).Namespace("team-a").Get(context.Background(), "recreated-fqdn", metav1.GetOptions{}); err != nil {
+		t.Errorf("fqdn network policy of the pod created after listing deleted, got %v", err)
+	}
+
+	deletes := 0
+	for _, action := range client.Actions() {
+		deleteAction, ok := action.(k8stesting.DeleteAction)
+		if !ok {
+			continue
+		}
+		deletes++
+		if deleteAction.GetName() != "orphan" {
+			t.Errorf("reconcile() deleted %v, want only the orphan deleted", deleteAction.GetName())
+		}
+		if deleteAction.GetDeleteOptions().Preconditions == nil {
+			t.Errorf("reconcile() deleted %v without preconditions", deleteAction.GetName())
+		}
+	}
+	if deletes != 1 {
+		t.Errorf("reconcile() deleted %v network policies, want 1", deletes)
+	}
+}
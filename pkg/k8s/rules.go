@@ -0,0 +1,83 @@
+package k8s
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/navikt/knep/pkg/hostmap"
+)
+
+// egressRule allows egress to every host on every port of the rule.
+type egressRule struct {
+	hosts []string
+	ports []hostmap.Port
+}
+
+// groupEgressRules normalises the allowed hosts per port into as few egress rules as
+// possible. Ports with the same set of hosts share a rule, or hosts with the same set of
+// ports do, whichever gives fewer rules. The rules, and the hosts and ports in them, are
+// sorted so that the same allowlist always produces the same policy spec.
+func groupEgressRules(portHostMap map[hostmap.Port][]string) []egressRule {
+	hostsByPort := map[hostmap.Port][]string{}
+	portsByHost := map[string][]hostmap.Port{}
+	for port, hosts := range portHostMap {
+		for _, host := range hosts {
+			if !slices.Contains(hostsByPort[port], host) {
+				hostsByPort[port] = append(hostsByPort[port], host)
+				portsByHost[host] = append(portsByHost[host], port)
+			}
+		}
+	}
+
+	byPorts := map[string]*egressRule{}
+	for port, hosts := range hostsByPort {
+		slices.Sort(hosts)
+		key := strings.Join(hosts, ",")
+		if _, ok := byPorts[key]; !ok {
+			byPorts[key] = &egressRule{hosts: hosts}
+		}
+		byPorts[key].ports = append(byPorts[key].ports, port)
+	}
+
+	byHosts := map[string]*egressRule{}
+	for host, ports := range portsByHost {
+		slices.SortFunc(ports, hostmap.ComparePorts)
+		key := joinPorts(ports)
+		if _, ok := byHosts[key]; !ok {
+			byHosts[key] = &egressRule{ports: ports}
+		}
+		byHosts[key].hosts = append(byHosts[key].hosts, host)
+	}
+
+	grouped := byPorts
+	if len(byHosts) < len(byPorts) {
+		grouped = byHosts
+	}
+
+	rules := []egressRule{}
+	for _, rule := range grouped {
+		slices.Sort(rule.hosts)
+		slices.SortFunc(rule.ports, hostmap.ComparePorts)
+		rules = append(rules, *rule)
+	}
+	slices.SortFunc(rules, compareEgressRules)
+
+	return rules
+}
+
+func compareEgressRules(a, b egressRule) int {
+	if c := slices.CompareFunc(a.ports, b.ports, hostmap.ComparePorts); c != 0 {
+		return c
+	}
+
+	return slices.Compare(a.hosts, b.hosts)
+}
+
+func joinPorts(ports []hostmap.Port) string {
+	formatted := make([]string, len(ports))
+	for i, port := range ports {
+		formatted[i] = port.String()
+	}
+
+	return strings.Join(formatted, ",")
+}
@@ -0,0 +1,107 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/hostmap"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func tcpPort(number int32) hostmap.Port {
+	return hostmap.Port{Number: number, Protocol: hostmap.ProtocolTCP}
+}
+
+func Test_groupEgressRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		portHostMap map[hostmap.Port][]string
+		want        []egressRule
+	}{
+		{
+			name: "ports with the same hosts share a rule",
+			portHostMap: map[hostmap.Port][]string{
+				tcpPort(443):  {"b.nav.no", "a.nav.no"},
+				tcpPort(80):   {"a.nav.no", "b.nav.no"},
+				tcpPort(1521): {"db.nav.no"},
+			},
+			want: []egressRule{
+				{hosts: []string{"a.nav.no", "b.nav.no"}, ports: []hostmap.Port{tcpPort(80), tcpPort(443)}},
+				{hosts: []string{"db.nav.no"}, ports: []hostmap.Port{tcpPort(1521)}},
+			},
+		},
+		{
+			name: "hosts with the same ports share a rule",
+			portHostMap: map[hostmap.Port][]string{
+				tcpPort(80):   {"a.nav.no"},
+				tcpPort(443):  {"a.nav.no", "b.nav.no"},
+				tcpPort(8080): {"b.nav.no"},
+			},
+			want: []egressRule{
+				{hosts: []string{"a.nav.no"}, ports: []hostmap.Port{tcpPort(80), tcpPort(443)}},
+				{hosts: []string{"b.nav.no"}, ports: []hostmap.Port{tcpPort(443), tcpPort(8080)}},
+			},
+		},
+		{
+			name: "duplicate hosts are removed",
+			portHostMap: map[hostmap.Port][]string{
+				tcpPort(443): {"a.nav.no", "a.nav.no"},
+			},
+			want: []egressRule{
+				{hosts: []string{"a.nav.no"}, ports: []hostmap.Port{tcpPort(443)}},
+			},
+		},
+		{
+			name:        "empty",
+			portHostMap: map[hostmap.Port][]string{},
+			want:        []egressRule{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := groupEgressRules(tt.portHostMap)
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(egressRule{})); diff != "" {
+				t.Errorf("groupEgressRules() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_createNetworkPolicyStableSpec(t *testing.T) {
+	k := newTestK8SClient(t, nil)
+	portHostMap := map[hostmap.Port][]string{
+		tcpPort(443):  {"10.0.0.2", "10.0.0.1"},
+		tcpPort(8443): {"10.0.0.1", "10.0.0.2"},
+		tcpPort(1521): {"10.0.1.1"},
+		tcpPort(1522): {"10.0.1.1"},
+		tcpPort(5432): {"10.0.2.1"},
+	}
+
+	tcp := corev1.ProtocolTCP
+	peer := func(cidr string) networkingv1.NetworkPolicyPeer {
+		return networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}}
+	}
+	port := func(number int32) networkingv1.NetworkPolicyPort {
+		return networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &intstr.IntOrString{IntVal: number}}
+	}
+	want := []networkingv1.NetworkPolicyEgressRule{
+		{To: []networkingv1.NetworkPolicyPeer{peer("10.0.0.1/32"), peer("10.0.0.2/32")}, Ports: []networkingv1.NetworkPolicyPort{port(443), port(8443)}},
+		{To: []networkingv1.NetworkPolicyPeer{peer("10.0.1.1/32")}, Ports: []networkingv1.NetworkPolicyPort{port(1521), port(1522)}},
+		{To: []networkingv1.NetworkPolicyPeer{peer("10.0.2.1/32")}, Ports: []networkingv1.NetworkPolicyPort{port(5432)}},
+	}
+
+	// Map iteration order is random, so repeated runs must give the same spec
+	for range 10 {
+		networkPolicy, err := k.createNetworkPolicy(metav1.ObjectMeta{Name: "pod", Namespace: "team-a"}, metav1.LabelSelector{}, portHostMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, networkPolicy.Spec.Egress); diff != "" {
+			t.Fatalf("createNetworkPolicy() egress mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
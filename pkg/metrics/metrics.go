@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "knep"
+
+var Registry = prometheus.NewRegistry()
+
+var AdmissionRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "admission_requests_total",
+	Help:      "Number of admission requests handled, by webhook, operation and outcome.",
+}, []string{"webhook", "operation", "outcome"})
+
+var AlterNetpolDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "alter_netpol_duration_seconds",
+	Help:      "Time spent altering network policies for an admission request, by operation.",
+	Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30},
+}, []string{"operation"})
+
+var FQDNNetpolRetries = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "fqdn_netpol_retries_total",
+	Help:      "Number of retried attempts at creating or updating an FQDN network policy.",
+})
+
+var NetpolCreatedTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "netpol_created_timeouts_total",
+	Help:      "Number of times the network policy for an FQDN network policy was not created before the timeout.",
+})
+
+var StatisticsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "statistics_dropped_total",
+	Help:      "Number of allowlist statistics that were never written, by reason.",
+}, []string{"reason"})
+
+var StatisticsSpilled = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "statistics_spilled_total",
+	Help:      "Number of allowlist statistics written to the spill directory because the queue was full.",
+})
+
+var OrphanedPoliciesDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "orphaned_policies_deleted_total",
+	Help:      "Number of knep managed policies deleted by the reconciler because their pod no longer exists.",
+}, []string{"kind"})
+
+var PolicyWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "policy_writes_total",
+	Help:      "Number of policy writes, by kind and action. Updates that would not change the policy are counted as skip.",
+}, []string{"kind", "action"})
+
+var PolicyApplyConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "policy_apply_conflicts_total",
+	Help:      "Number of policies where fields owned by knep had been changed by another field manager, by kind.",
+}, []string{"kind"})
+
+var GuardrailViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "guardrail_violations_total",
+	Help:      "Number of allowlist entries violating the platform guardrails, by rule.",
+}, []string{"rule"})
+
+var HostMapInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "hostmap_info",
+	Help:      "The version of the host map in use, derived from the content of the host map files.",
+}, []string{"version"})
+
+var HostMapLoadedTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "hostmap_loaded_timestamp_seconds",
+	Help:      "Unix time the host map in use was loaded.",
+})
+
+var HostMapReloadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "hostmap_reload_failures_total",
+	Help:      "Number of times the host map files could not be reloaded and the last good version was kept.",
+})
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		AdmissionRequests,
+		AlterNetpolDuration,
+		FQDNNetpolRetries,
+		NetpolCreatedTimeouts,
+		StatisticsDropped,
+		StatisticsSpilled,
+		OrphanedPoliciesDeleted,
+		PolicyWrites,
+		PolicyApplyConflicts,
+		GuardrailViolations,
+		HostMapInfo,
+		HostMapLoadedTimestamp,
+		HostMapReloadFailures,
+	)
+}
+
+// RegisterStatisticsQueueDepth exposes the number of allowlist statistics waiting to be written.
+func RegisterStatisticsQueueDepth(depth func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "statistics_queue_depth",
+		Help:      "Number of allowlist statistics waiting to be written.",
+	}, func() float64 {
+		return float64(depth())
+	}))
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,232 @@
+package statswriter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/navikt/knep/pkg/metrics"
+)
+
+type OverflowPolicy string
+
+const (
+	// OverflowPolicyDropOldest drops the oldest queued statistics to make room for new ones
+	OverflowPolicyDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowPolicyDropNewest drops new statistics while the queue is full
+	OverflowPolicyDropNewest OverflowPolicy = "drop-newest"
+	// OverflowPolicySpillToDisk writes statistics to files in the spill directory while the
+	// queue is full, which are written to BigQuery later
+	OverflowPolicySpillToDisk OverflowPolicy = "spill-to-disk"
+)
+
+const spillFileSuffix = ".json"
+
+// Queue buffers allowlist statistics for the writer. Sending never blocks, statistics
+// that do not fit in the queue are handled by the overflow policy.
+type Queue struct {
+	statistics chan AllowListStatistics
+	policy     OverflowPolicy
+	spillDir   string
+	spilled    atomic.Uint64
+	logger     *slog.Logger
+	// mu guards closing the channel against concurrent sends
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewQueue returns a queue holding up to size statistics. The spill directory is only
+// used with the spill-to-disk overflow policy, and is created if it does not exist.
+func NewQueue(size int, policy OverflowPolicy, spillDir string, logger *slog.Logger) (*Queue, error) {
+	switch policy {
+	case OverflowPolicyDropOldest, OverflowPolicyDropNewest:
+	case OverflowPolicySpillToDisk:
+		if spillDir == "" {
+			return nil, fmt.Errorf("the %v overflow policy requires a spill directory", policy)
+		}
+		// Spilled statistics hold the allowlists of the pods, so only knep may read them
+		if err := os.MkdirAll(spillDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create spill directory %s: %w", spillDir, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q, expected one of drop-oldest, drop-newest or spill-to-disk", policy)
+	}
+
+	return &Queue{
+		statistics: make(chan AllowListStatistics, size),
+		policy:     policy,
+		spillDir:   spillDir,
+		logger:     logger,
+	}, nil
+}
+
+// Send queues the statistics without blocking. Sending to a nil queue, as when writing
+// statistics is disabled, does nothing, and statistics sent after Close are dropped.
+func (q *Queue) Send(allowStats AllowListStatistics) {
+	if q == nil {
+		return
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		metrics.StatisticsDropped.WithLabelValues("shutdown").Inc()
+		return
+	}
+
+	select {
+	case q.statistics <- allowStats:
+		return
+	default:
+	}
+
+	switch q.policy {
+	case OverflowPolicyDropNewest:
+		metrics.StatisticsDropped.WithLabelValues("overflow").Inc()
+	case OverflowPolicyDropOldest:
+		// Other senders can fill the room made, so this is repeated until the statistics fit
+		for {
+			select {
+			case <-q.statistics:
+				metrics.StatisticsDropped.WithLabelValues("overflow").Inc()
+			default:
+			}
+
+			select {
+			case q.statistics <- allowStats:
+				return
+			default:
+			}
+		}
+	case OverflowPolicySpillToDisk:
+		if err := q.spill(allowStats); err != nil {
+			q.logger.Error("spilling allowlist stats", "error", err, "podname", allowStats.Pod.Name, "namespace", allowStats.Pod.Namespace)
+			metrics.StatisticsDropped.WithLabelValues("spill_failed").Inc()
+			return
+		}
+		metrics.StatisticsSpilled.Inc()
+	}
+}
+
+// Len returns the number of queued statistics.
+func (q *Queue) Len() int {
+	if q == nil {
+		return 0
+	}
+
+	return len(q.statistics)
+}
+
+// Close tells the writer no more statistics will be sent.
+func (q *Queue) Close() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.statistics)
+	}
+}
+
+// spill writes the table entry for the statistics to a new file in the spill directory.
+// The file is written under a temporary name and renamed, so replay never reads a
+// partially written file.
+func (q *Queue) spill(allowStats AllowListStatistics) error {
+	tableEntry, err := newAllowListTableEntry(allowStats)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(tableEntry)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), q.spilled.Add(1)%1000000)
+	tmpPath := filepath.Join(q.spillDir, name+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(q.spillDir, name+spillFileSuffix))
+}
+
+// spillQueued moves the queued statistics to the spill directory, returning how many
+// could not be spilled.
+func (q *Queue) spillQueued() int {
+	failed := 0
+	for {
+		select {
+		case allowStats, ok := <-q.statistics:
+			if !ok {
+				return failed
+			}
+			if err := q.spill(allowStats); err != nil {
+				q.logger.Error("spilling allowlist stats", "error", err, "podname", allowStats.Pod.Name, "namespace", allowStats.Pod.Namespace)
+				failed++
+				continue
+			}
+			metrics.StatisticsSpilled.Inc()
+		default:
+			return failed
+		}
+	}
+}
+
+// replaySpilled passes the spilled table entries to persist, oldest first, removing each
+// file once persisted. It stops at the first error, leaving the rest for the next replay.
+func (q *Queue) replaySpilled(persist func(allowListTableEntry) error) error {
+	if q.spillDir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(q.spillDir)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == spillFileSuffix {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		path := filepath.Join(q.spillDir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var tableEntry allowListTableEntry
+		if err := json.Unmarshal(data, &tableEntry); err != nil {
+			// A file that can not be parsed will never be written, so it is not kept around
+			q.logger.Error("parsing spilled allowlist stats", "error", err, "file", path)
+			metrics.StatisticsDropped.WithLabelValues("spill_failed").Inc()
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := persist(tableEntry); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package statswriter
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testStatistics(podName string) AllowListStatistics {
+	return AllowListStatistics{
+		HostMap: hostmap.AllowIPFQDN{
+			IP:   map[hostmap.Port][]string{{Number: 514, Protocol: hostmap.ProtocolUDP}: {"10.0.0.1"}},
+			FQDN: map[hostmap.Port][]string{{Number: 8000, EndPort: 8001, Protocol: hostmap.ProtocolTCP}: {"pypi.org"}},
+		},
+		Pod:        corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: "team-a"}},
+		Service:    "airflow",
+		Team:       "team-a",
+		PodEntries: []string{"pypi.org:8000-8001", "10.0.0.1:514/udp"},
+	}
+}
+
+func newTestQueue(t *testing.T, policy OverflowPolicy, spillDir string) *Queue {
+	t.Helper()
+
+	queue, err := NewQueue(2, policy, spillDir, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return queue
+}
+
+func queuedPods(queue *Queue) []string {
+	pods := []string{}
+	for queue.Len() > 0 {
+		pods = append(pods, (<-queue.statistics).Pod.Name)
+	}
+
+	return pods
+}
+
+func Test_QueueDropOldest(t *testing.T) {
+	queue := newTestQueue(t, OverflowPolicyDropOldest, "")
+	droppedBefore := testutil.ToFloat64(metrics.StatisticsDropped.WithLabelValues("overflow"))
+
+	for _, pod := range []string{"first", "second", "third"} {
+		queue.Send(testStatistics(pod))
+	}
+
+	if diff := cmp.Diff([]string{"second", "third"}, queuedPods(queue)); diff != "" {
+		t.Errorf("queued pods mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(metrics.StatisticsDropped.WithLabelValues("overflow")) - droppedBefore; got != 1 {
+		t.Errorf("dropped statistics = %v, want 1", got)
+	}
+}
+
+func Test_QueueDropNewest(t *testing.T) {
+	queue := newTestQueue(t, OverflowPolicyDropNewest, "")
+	droppedBefore := testutil.ToFloat64(metrics.StatisticsDropped.WithLabelValues("overflow"))
+
+	for _, pod := range []string{"first", "second", "third"} {
+		queue.Send(testStatistics(pod))
+	}
+
+	if diff := cmp.Diff([]string{"first", "second"}, queuedPods(queue)); diff != "" {
+		t.Errorf("queued pods mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(metrics.StatisticsDropped.WithLabelValues("overflow")) - droppedBefore; got != 1 {
+		t.Errorf("dropped statistics = %v, want 1", got)
+	}
+}
+
+func Test_QueueSpillToDisk(t *testing.T) {
+	spillDir := t.TempDir()
+	queue := newTestQueue(t, OverflowPolicySpillToDisk, spillDir)
+	spilledBefore := testutil.ToFloat64(metrics.StatisticsSpilled)
+
+	for _, pod := range []string{"first", "second", "third", "fourth", "fifth"} {
+		queue.Send(testStatistics(pod))
+	}
+	// The queued statistics are spilled after the overflowing ones when shutting down
+	if failed := queue.spillQueued(); failed != 0 {
+		t.Fatalf("spillQueued() failed = %v, want 0", failed)
+	}
+
+	if got := testutil.ToFloat64(metrics.StatisticsSpilled) - spilledBefore; got != 5 {
+		t.Errorf("spilled statistics = %v, want 5", got)
+	}
+
+	// Spill files hold the allowlists of the pods, so only knep may read them
+	spilled, err := os.ReadDir(spillDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range spilled {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("spill file %v has mode %v, want 0600", entry.Name(), info.Mode().Perm())
+		}
+	}
+
+	// A failed write keeps the file and every later one for the next replay
+	persistErr := errors.New("bigquery unavailable")
+	if err := queue.replaySpilled(func(allowListTableEntry) error { return persistErr }); !errors.Is(err, persistErr) {
+		t.Fatalf("replaySpilled() error = %v, want %v", err, persistErr)
+	}
+
+	persisted := []allowListTableEntry{}
+	err = queue.replaySpilled(func(tableEntry allowListTableEntry) error {
+		persisted = append(persisted, tableEntry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []allowListTableEntry{}
+	for _, pod := range []string{"third", "fourth", "fifth", "first", "second"} {
+		tableEntry, err := newAllowListTableEntry(testStatistics(pod))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, tableEntry)
+	}
+	if diff := cmp.Diff(want, persisted); diff != "" {
+		t.Errorf("replaySpilled() mismatch (-want +got):\n%s", diff)
+	}
+
+	entries, err := os.ReadDir(spillDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("spill directory has %v files after replay, want none", len(entries))
+	}
+}
+
+func Test_NewQueue(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	if _, err := NewQueue(10, OverflowPolicySpillToDisk, "", logger); err == nil {
+		t.Errorf("NewQueue() without a spill directory error = nil, want an error")
+	}
+	if _, err := NewQueue(10, "block", "", logger); err == nil {
+		t.Errorf("NewQueue() with an unknown policy error = nil, want an error")
+	}
+
+	// Writing statistics is disabled with a nil queue, which must never block
+	var queue *Queue
+	queue.Send(testStatistics("pod"))
+	if queue.Len() != 0 {
+		t.Errorf("Len() = %v for a nil queue, want 0", queue.Len())
+	}
+}
+
+func Test_QueueSendAfterClose(t *testing.T) {
+	queue := newTestQueue(t, OverflowPolicyDropNewest, "")
+	droppedBefore := testutil.ToFloat64(metrics.StatisticsDropped.WithLabelValues("shutdown"))
+
+	queue.Send(testStatistics("queued"))
+	queue.Close()
+	// Admissions still running after the admission server failed to shut down send after Close
+	queue.Send(testStatistics("late"))
+	queue.Close()
+
+	if diff := cmp.Diff([]string{"queued"}, queuedPods(queue)); diff != "" {
+		t.Errorf("queued pods mismatch (-want +got):\n%s", diff)
+	}
+	if got := testutil.ToFloat64(metrics.StatisticsDropped.WithLabelValues("shutdown")) - droppedBefore; got != 1 {
+		t.Errorf("dropped statistics = %v, want 1", got)
+	}
+}
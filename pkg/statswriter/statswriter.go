@@ -5,24 +5,38 @@ import (
 	"encoding/json"
 	"errors"
 	"log/slog"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/navikt/knep/pkg/hostmap"
+	"github.com/navikt/knep/pkg/metrics"
 	"google.golang.org/api/googleapi"
 	corev1 "k8s.io/api/core/v1"
 )
 
+// AllowListStatistics holds the allowlist of a pod, with the entries from the pod itself
+// kept apart from the default entries of its team. Service and Team are derived from the
+// workload profile of the pod.
 type AllowListStatistics struct {
-	HostMap hostmap.AllowIPFQDN
-	Pod     corev1.Pod
+	HostMap     hostmap.AllowIPFQDN
+	Pod         corev1.Pod
+	Service     string
+	Team        string
+	PodEntries  []string
+	TeamEntries []string
 }
 
+// spillReplayInterval is how often statistics spilled to disk are written to BigQuery.
+const spillReplayInterval = 30 * time.Second
+
 type BigQuery struct {
 	ProjectID string
 	DatasetID string
 	TableID   string
 }
 
+// allowListTableEntry is a row in the statistics table. It is also what is spilled to
+// disk, so spill files hold only what is written to BigQuery and never the whole pod.
 type allowListTableEntry struct {
 	PodName   string                 `json:"podname"`
 	Team      string                 `json:"team"`
@@ -30,9 +44,18 @@ type allowListTableEntry struct {
 	Service   string                 `json:"service"`
 	Allowlist bigquery.NullJSON      `json:"allowlist"`
 	Created   bigquery.NullTimestamp `json:"created"`
+	// The inserter infers the schema from the field names, or the bigquery tags where
+	// set, so these must match the column names. The json tags name the fields in spill files.
+	PodAllowlist  []string `json:"podallowlist" bigquery:"podallowlist"`
+	TeamAllowlist []string `json:"teamallowlist" bigquery:"teamallowlist"`
 }
 
-func Run(ctx context.Context, sink BigQuery, statisticsChan chan AllowListStatistics, logger *slog.Logger) {
+// Run writes the statistics sent to the queue to BigQuery until the queue is closed, so
+// the statistics queued when shutting down are written before Run returns. Cancelling
+// ctx stops Run at once, the queued statistics are then spilled to disk with the
+// spill-to-disk overflow policy and dropped otherwise. Spilled statistics are written
+// periodically, including those spilled before a restart.
+func Run(ctx context.Context, sink BigQuery, queue *Queue, logger *slog.Logger) {
 	bqClient, err := bigquery.NewClient(ctx, bigquery.DetectProjectID)
 	if err != nil {
 		logger.Error("unable to create bigquery client", "error", err)
@@ -48,13 +71,39 @@ func Run(ctx context.Context, sink BigQuery, statisticsChan chan AllowListStatis
 		return
 	}
 
+	ticker := time.NewTicker(spillReplayInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
+			queued := queue.Len()
+			if queue.policy == OverflowPolicySpillToDisk {
+				queued = queue.spillQueued()
+			}
+			if queued > 0 {
+				logger.Warn("dropping queued allowlist stats", "count", queued)
+				metrics.StatisticsDropped.WithLabelValues("shutdown").Add(float64(queued))
+			}
 			return
-		case allowStats := <-statisticsChan:
-			if err := persistAllowlistStats(ctx, sink, allowStats.HostMap, allowStats.Pod); err != nil {
+		case allowStats, ok := <-queue.statistics:
+			if !ok {
+				return
+			}
+			tableEntry, err := newAllowListTableEntry(allowStats)
+			if err == nil {
+				err = persistAllowlistStats(ctx, sink, tableEntry)
+			}
+			if err != nil {
 				logger.Error("persisting allowlist stats", "error", err, "podname", allowStats.Pod.Name, "namespace", allowStats.Pod.Namespace)
+				metrics.StatisticsDropped.WithLabelValues("persist_failed").Inc()
+			}
+		case <-ticker.C:
+			err := queue.replaySpilled(func(tableEntry allowListTableEntry) error {
+				return persistAllowlistStats(ctx, sink, tableEntry)
+			})
+			if err != nil {
+				logger.Error("persisting spilled allowlist stats, retrying later", "error", err)
 			}
 		}
 	}
@@ -68,6 +117,8 @@ func createAllowlistStatsTableIfNotExists(ctx context.Context, bqClient *bigquer
 		{Name: "team", Type: bigquery.StringFieldType},
 		{Name: "service", Type: bigquery.StringFieldType},
 		{Name: "allowlist", Type: bigquery.JSONFieldType},
+		{Name: "podallowlist", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "teamallowlist", Type: bigquery.StringFieldType, Repeated: true},
 	}
 
 	metadata := &bigquery.TableMetadata{
@@ -80,48 +131,67 @@ func createAllowlistStatsTableIfNotExists(ctx context.Context, bqClient *bigquer
 	if ok := errors.As(err, &e); ok {
 		if e.Code == 409 {
 			// already exists
-			return nil
+			return addMissingColumns(ctx, ds.Table(tableID), schema)
 		}
 	}
 
 	return nil
 }
 
-func persistAllowlistStats(ctx context.Context, sink BigQuery, allowStruct any, pod corev1.Pod) error {
-	bqClient, err := bigquery.NewClient(ctx, bigquery.DetectProjectID)
+// addMissingColumns adds the columns of the schema that were introduced after the table
+// was created. Columns can only be appended, existing columns are left as they are.
+func addMissingColumns(ctx context.Context, table *bigquery.Table, schema bigquery.Schema) error {
+	metadata, err := table.Metadata(ctx)
 	if err != nil {
 		return err
 	}
-	defer bqClient.Close()
 
-	table := bqClient.DatasetInProject(sink.ProjectID, sink.DatasetID).Table(sink.TableID)
+	existing := map[string]bool{}
+	for _, field := range metadata.Schema {
+		existing[field.Name] = true
+	}
 
-	allowBytes, err := json.Marshal(allowStruct)
-	if err != nil {
-		return err
+	updatedSchema := metadata.Schema
+	for _, field := range schema {
+		if !existing[field.Name] {
+			updatedSchema = append(updatedSchema, field)
+		}
 	}
+	if len(updatedSchema) == len(metadata.Schema) {
+		return nil
+	}
+
+	_, err = table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: updatedSchema}, metadata.ETag)
+	return err
+}
 
-	service, team := getServiceTypeAndTeamFromPodSpec(pod)
-	tableEntry := allowListTableEntry{
-		PodName:   pod.Name,
-		Team:      team,
-		Namespace: pod.Namespace,
-		Service:   service,
-		Allowlist: bigquery.NullJSON{JSONVal: string(allowBytes), Valid: string(allowBytes) != ""},
-		Created:   bigquery.NullTimestamp{Timestamp: pod.CreationTimestamp.Time, Valid: true},
+func newAllowListTableEntry(allowStats AllowListStatistics) (allowListTableEntry, error) {
+	pod := allowStats.Pod
+	allowBytes, err := json.Marshal(allowStats.HostMap)
+	if err != nil {
+		return allowListTableEntry{}, err
 	}
 
-	return table.Inserter().Put(ctx, tableEntry)
+	return allowListTableEntry{
+		PodName:       pod.Name,
+		Team:          allowStats.Team,
+		Namespace:     pod.Namespace,
+		Service:       allowStats.Service,
+		Allowlist:     bigquery.NullJSON{JSONVal: string(allowBytes), Valid: string(allowBytes) != ""},
+		Created:       bigquery.NullTimestamp{Timestamp: pod.CreationTimestamp.Time, Valid: true},
+		PodAllowlist:  allowStats.PodEntries,
+		TeamAllowlist: allowStats.TeamEntries,
+	}, nil
 }
 
-func getServiceTypeAndTeamFromPodSpec(pod corev1.Pod) (string, string) {
-	if serviceType, ok := pod.Labels["app"]; ok && serviceType == "jupyterhub" {
-		team := ""
-		if teamName, ok := pod.Labels["team"]; ok {
-			team = teamName
-		}
-		return serviceType, team
+func persistAllowlistStats(ctx context.Context, sink BigQuery, tableEntry allowListTableEntry) error {
+	bqClient, err := bigquery.NewClient(ctx, bigquery.DetectProjectID)
+	if err != nil {
+		return err
 	}
+	defer bqClient.Close()
 
-	return "airflow", pod.Spec.ServiceAccountName
+	table := bqClient.DatasetInProject(sink.ProjectID, sink.DatasetID).Table(sink.TableID)
+
+	return table.Inserter().Put(ctx, tableEntry)
 }
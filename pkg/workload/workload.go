@@ -0,0 +1,213 @@
+package workload
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Profile describes a type of workload that knep creates network policies for, such as
+// Jupyter notebooks or Airflow task pods.
+type Profile struct {
+	Name string `yaml:"name"`
+	// MatchLabels and MatchExpressions select the pods of the workload, with the same
+	// semantics as a Kubernetes label selector
+	MatchLabels      map[string]string `yaml:"matchLabels"`
+	MatchExpressions []MatchExpression `yaml:"matchExpressions"`
+	// SelectorLabels are copied from the pod into the pod selector of its network policies.
+	// A missing label is selected with an empty value, unless RequireSelectorLabels is set
+	// and the pod is denied
+	SelectorLabels        []string `yaml:"selectorLabels"`
+	RequireSelectorLabels bool     `yaml:"requireSelectorLabels"`
+	// SharedPolicyLabels identify a group of pods, such as the task pods in an Airflow DAG
+	// run, that share their network policies when shared DAG run policies are enabled.
+	// The value of the first label is used in the policy names
+	SharedPolicyLabels []string `yaml:"sharedPolicyLabels"`
+	// Service and Team are written to the allowlist statistics
+	Service ValueFrom `yaml:"service"`
+	Team    ValueFrom `yaml:"team"`
+
+	selector labels.Selector
+}
+
+type MatchExpression struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values"`
+}
+
+// ValueFrom derives a value from a pod. The first of Value, Label and Field that is set
+// is used.
+type ValueFrom struct {
+	Value string `yaml:"value"`
+	Label string `yaml:"label"`
+	// Field is one of namespace or serviceAccountName
+	Field string `yaml:"field"`
+}
+
+// Profiles are matched against pods in order, the first matching profile is used.
+type Profiles []Profile
+
+type profilesFile struct {
+	Profiles []Profile `yaml:"profiles"`
+}
+
+// Defaults returns the built-in profiles for Jupyter notebooks and Airflow task pods.
+func Defaults() Profiles {
+	profiles := Profiles{
+		{
+			Name:           "jupyter",
+			MatchLabels:    map[string]string{"component": "singleuser-server"},
+			SelectorLabels: []string{"component", "hub.jupyter.org/username"},
+			Service:        ValueFrom{Value: "jupyterhub"},
+			Team:           ValueFrom{Label: "team"},
+		},
+		{
+			Name:             "airflow",
+			MatchExpressions: []MatchExpression{{Key: "dag_id", Operator: string(metav1.LabelSelectorOpExists)}},
+			SelectorLabels:   []string{"run_id", "dag_id", "task_id"},
+			// The first shared policy label is the DAG id, which keeps shared policy names readable
+			SharedPolicyLabels: []string{"dag_id", "run_id"},
+			Service:            ValueFrom{Value: "airflow"},
+			Team:               ValueFrom{Field: "serviceAccountName"},
+		},
+	}
+
+	for i := range profiles {
+		if err := profiles[i].compile(); err != nil {
+			panic(err)
+		}
+	}
+
+	return profiles
+}
+
+// Load reads the profiles in the file at path. The profiles are matched before the
+// built-in defaults, and a profile with the same name as a default replaces it. An
+// empty path gives the defaults.
+func Load(path string) (Profiles, error) {
+	if path == "" {
+		return Defaults(), nil
+	}
+
+	profilesBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+
+	var file profilesFile
+	if err := yaml.UnmarshalStrict(profilesBytes, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse file %s: %w", path, err)
+	}
+
+	profiles := Profiles{}
+	for _, profile := range file.Profiles {
+		if err := profile.compile(); err != nil {
+			return nil, fmt.Errorf("invalid workload profile %v in file %s: %w", profile.Name, path, err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	for _, profile := range Defaults() {
+		if !slices.ContainsFunc(profiles, func(p Profile) bool { return p.Name == profile.Name }) {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	return profiles, nil
+}
+
+func (p *Profile) compile() error {
+	if p.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if len(p.MatchLabels) == 0 && len(p.MatchExpressions) == 0 {
+		return fmt.Errorf("missing matchLabels or matchExpressions")
+	}
+	if len(p.SelectorLabels) == 0 {
+		return fmt.Errorf("missing selectorLabels")
+	}
+	for _, valueFrom := range []ValueFrom{p.Service, p.Team} {
+		switch valueFrom.Field {
+		case "", "namespace", "serviceAccountName":
+		default:
+			return fmt.Errorf("unsupported field %v, expected namespace or serviceAccountName", valueFrom.Field)
+		}
+	}
+
+	labelSelector := &metav1.LabelSelector{MatchLabels: p.MatchLabels}
+	for _, expression := range p.MatchExpressions {
+		labelSelector.MatchExpressions = append(labelSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      expression.Key,
+			Operator: metav1.LabelSelectorOperator(expression.Operator),
+			Values:   expression.Values,
+		})
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return err
+	}
+	p.selector = selector
+
+	return nil
+}
+
+// Match returns the first profile matching the pod labels.
+func (p Profiles) Match(podLabels map[string]string) (Profile, bool) {
+	for _, profile := range p {
+		if profile.selector.Matches(labels.Set(podLabels)) {
+			return profile, true
+		}
+	}
+
+	return Profile{}, false
+}
+
+// PodSelector returns the pod selector for the network policies of the pod, matching
+// the selector labels of the pod.
+func (p Profile) PodSelector(pod corev1.Pod) (metav1.LabelSelector, error) {
+	matchLabels := map[string]string{}
+	for _, key := range p.SelectorLabels {
+		value, ok := pod.Labels[key]
+		if !ok && p.RequireSelectorLabels {
+			return metav1.LabelSelector{}, fmt.Errorf("pod %v is missing the label %v required by the %v workload profile", pod.Name, key, p.Name)
+		}
+		matchLabels[key] = value
+	}
+
+	return metav1.LabelSelector{MatchLabels: matchLabels}, nil
+}
+
+// SharesPolicies reports whether the pod shares its network policies with the other
+// pods with the same shared policy labels, which requires the pod to have all of them.
+func (p Profile) SharesPolicies(pod corev1.Pod) bool {
+	return len(p.SharedPolicyLabels) > 0 && !slices.ContainsFunc(p.SharedPolicyLabels, func(key string) bool {
+		return pod.Labels[key] == ""
+	})
+}
+
+// ServiceAndTeam returns the service and team of the pod for the allowlist statistics.
+func (p Profile) ServiceAndTeam(pod corev1.Pod) (string, string) {
+	return p.Service.value(pod), p.Team.value(pod)
+}
+
+func (v ValueFrom) value(pod corev1.Pod) string {
+	switch {
+	case v.Value != "":
+		return v.Value
+	case v.Label != "":
+		return pod.Labels[v.Label]
+	case v.Field == "namespace":
+		return pod.Namespace
+	case v.Field == "serviceAccountName":
+		return pod.Spec.ServiceAccountName
+	}
+
+	return ""
+}
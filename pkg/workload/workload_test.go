@@ -0,0 +1,181 @@
+package workload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_Match(t *testing.T) {
+	profiles, err := Load("testdata/profiles.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		want        string
+		wantMatch   bool
+		wantService string
+		wantTeam    string
+		wantLabels  map[string]string
+	}{
+		{
+			name:        "jupyter default",
+			labels:      map[string]string{"component": "singleuser-server", "hub.jupyter.org/username": "user", "team": "team-a"},
+			want:        "jupyter",
+			wantMatch:   true,
+			wantService: "jupyterhub",
+			wantTeam:    "team-a",
+			wantLabels:  map[string]string{"component": "singleuser-server", "hub.jupyter.org/username": "user"},
+		},
+		{
+			name:        "airflow replaced by file",
+			labels:      map[string]string{"dag_id": "dag", "run_id": "run", "task_id": "task", "team": "team-a"},
+			want:        "airflow",
+			wantMatch:   true,
+			wantService: "airflow",
+			wantTeam:    "team-a",
+			wantLabels:  map[string]string{"dag_id": "dag", "task_id": "task"},
+		},
+		{
+			name:        "dagster from file",
+			labels:      map[string]string{"app.kubernetes.io/name": "dagster", "dagster/run-id": "run"},
+			want:        "dagster",
+			wantMatch:   true,
+			wantService: "dagster",
+			wantTeam:    "team-a",
+			wantLabels:  map[string]string{"dagster/run-id": "run"},
+		},
+		{
+			name:   "dagster without run",
+			labels: map[string]string{"app.kubernetes.io/name": "dagster"},
+		},
+		{
+			name:   "other workload",
+			labels: map[string]string{"app": "web"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, ok := profiles.Match(tt.labels)
+			if ok != tt.wantMatch || profile.Name != tt.want {
+				t.Fatalf("Match() = %v, %v, want %v, %v", profile.Name, ok, tt.want, tt.wantMatch)
+			}
+			if !ok {
+				return
+			}
+
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "team-a", Labels: tt.labels},
+				Spec:       corev1.PodSpec{ServiceAccountName: "team-a-sa"},
+			}
+			service, team := profile.ServiceAndTeam(pod)
+			if service != tt.wantService || team != tt.wantTeam {
+				t.Errorf("ServiceAndTeam() = %v, %v, want %v, %v", service, team, tt.wantService, tt.wantTeam)
+			}
+
+			podSelector, err := profile.PodSelector(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantLabels, podSelector.MatchLabels); diff != "" {
+				t.Errorf("PodSelector() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_Defaults(t *testing.T) {
+	profile, ok := Defaults().Match(map[string]string{"dag_id": "dag", "run_id": "run"})
+	if !ok {
+		t.Fatal("Match() found no profile for an airflow pod")
+	}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Labels: map[string]string{"dag_id": "dag", "run_id": "run"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "team-a"},
+	}
+	// The built-in profiles select a missing label with an empty value, as knep always has
+	podSelector, err := profile.PodSelector(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"dag_id": "dag", "run_id": "run", "task_id": ""}, podSelector.MatchLabels); diff != "" {
+		t.Errorf("PodSelector() mismatch (-want +got):\n%s", diff)
+	}
+	profile.RequireSelectorLabels = true
+	if _, err := profile.PodSelector(pod); err == nil {
+		t.Errorf("PodSelector() error = nil, want error for missing task_id label")
+	}
+
+	if service, team := profile.ServiceAndTeam(pod); service != "airflow" || team != "team-a" {
+		t.Errorf("ServiceAndTeam() = %v, %v, want airflow, team-a", service, team)
+	}
+	if !profile.SharesPolicies(pod) {
+		t.Errorf("SharesPolicies() = false for an airflow pod in a DAG run")
+	}
+	delete(pod.Labels, "run_id")
+	if profile.SharesPolicies(pod) {
+		t.Errorf("SharesPolicies() = true for an airflow pod without a run_id")
+	}
+}
+
+func Test_LoadInvalid(t *testing.T) {
+	if _, err := Load("testdata/missing.yaml"); err == nil {
+		t.Errorf("Load() error = nil, want error for missing file")
+	}
+
+	tests := []struct {
+		name     string
+		profiles string
+	}{
+		{
+			name: "invalid operator",
+			profiles: `profiles:
+  - name: dagster
+    matchExpressions:
+      - key: dagster/run-id
+        operator: Equals
+    selectorLabels:
+      - dagster/run-id`,
+		},
+		{
+			name: "missing selectorLabels",
+			profiles: `profiles:
+  - name: dagster
+    matchLabels:
+      app.kubernetes.io/name: dagster`,
+		},
+		{
+			name: "unknown field",
+			profiles: `profiles:
+  - name: dagster
+    matchLabels:
+      app.kubernetes.io/name: dagster
+    selectorLabels:
+      - dagster/run-id
+    sharedPolicyLabel:
+      - dagster/run-id`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "profiles.yaml")
+			if err := os.WriteFile(path, []byte(tt.profiles), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Load(path); err == nil {
+				t.Errorf("Load() error = nil, want error for %v", tt.name)
+			}
+		})
+	}
+}